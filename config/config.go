@@ -3,29 +3,616 @@ package config
 import (
 	"fmt"
 	"github.com/spf13/viper"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
-	APPNAME   = "oleservice"
-	CONF_NAME = "config"
+	APPNAME        = "oleservice"
+	CONF_NAME      = "config"
+	DEFAULT_LISTEN = ":9977"
+	// CONF_ENV names a config file to read instead of searching for one,
+	// set by start --detach for the daemon it starts.
+	CONF_ENV = "OLESERVICE_CONFIG"
+	// USER_SCOPE_ENV marks the user's own service, see UserScope; the
+	// unit install --user writes sets it for the daemon.
+	USER_SCOPE_ENV = "OLESERVICE_USER_SCOPE"
 )
 
+// Config is a validated snapshot of the settings the daemon runs with.
 type Config struct {
 	Name string
+
+	Msg            string
+	Greeting       bool // echo sends Msg to every client first
+	LogPath        string
+	Listen         string
+	PidFile        string
+	StateFile      string
+	DrainTimeout   time.Duration
+	UpgradeTimeout time.Duration
+	// ControlSocket is where the daemon answers the CLI, none when
+	// empty.
+	ControlSocket string
+	// LogLevel is "debug" or "info", see servicelib.SetLogLevel.
+	LogLevel string
+	// MaxConnections is how many clients are served at once, 0 for no
+	// limit.
+	MaxConnections int
+	// User and Group the daemon switches to once it has bound its
+	// listeners, when it starts as root.
+	User        string
+	Group       string
+	KeepNetBind bool
+	// Seccomp, SeccompAction, SeccompNotify and Landlock confine the
+	// daemon once it has bound its listeners, see servicelib.Sandbox.
+	Seccomp       bool
+	SeccompAction string
+	SeccompNotify bool
+	Landlock      bool
+	// Process is set up at start.
+	Process Process
+	// Exec is the program to run as the service instead of the echo
+	// server, when its Command is set.
+	Exec Exec
+	// File is the config file the settings came from, empty when there
+	// is none.
+	File string
+
+	// processErr is what was wrong with the [process] section.
+	processErr error
 }
 
-func SetDefault() {
-	viper.SetConfigName(CONF_NAME)
-	// viper.AddConfigPath(fmt.Sprintf("/etc/%s/", APPNAME))
+// Process is the [process] section: what the daemon sets up for itself
+// at start. Nil and empty fields leave what it was started with.
+type Process struct {
+	// Limits are soft rlimits by name, nofile, core, nproc and as, which
+	// raise the hard limit where it is lower; math.MaxUint64 is
+	// unlimited.
+	Limits           map[string]uint64
+	Umask            *int
+	WorkingDirectory string
+	OOMScoreAdj      *int
+	Nice             *int
+}
+
+// limitNames are the rlimits [process] sets.
+var limitNames = []string{"as", "core", "nofile", "nproc"}
+
+// Exec is the [exec] section: another program the daemon runs as its
+// child, see servicelib.Exec.
+type Exec struct {
+	Command string
+	Args    []string
+	// Env are KEY=value pairs added to the daemon's environment.
+	Env              []string
+	WorkingDirectory string
+	// User and Group the child runs as, which needs the daemon to run
+	// as root.
+	User  string
+	Group string
+	// Restart is "always" or "on-failure", when the child exits with a
+	// status other than 0 or by a signal.
+	Restart string
+	// RestartSec is the first wait before a restart, doubling while the
+	// child keeps crashing. After MaxRestarts within RestartPeriod the
+	// daemon gives up and fails.
+	RestartSec    time.Duration
+	MaxRestarts   int
+	RestartPeriod time.Duration
+	// StopSignal and ReloadSignal are passed on to the child, by name
+	// like "TERM"; an empty ReloadSignal leaves the child alone on
+	// reload.
+	StopSignal   string
+	ReloadSignal string
+}
+
+// SignalNames are the signals [exec] passes on to the child.
+var SignalNames = []string{"HUP", "INT", "QUIT", "TERM", "USR1", "USR2"}
 
-	viper.SetConfigName("config")
-	viper.SetConfigType("toml")
+func SetDefault() {
+	v := viper.GetViper()
+	setup(v)
 
 	err := viper.ReadInConfig()
 	if err != nil {
-		fmt.Println("No configuration file loaded - using defaults")
+		// stderr, so it does not end up in status --json output
+		fmt.Fprintln(os.Stderr, "No configuration file loaded - using defaults")
+	}
+}
+
+// UserScope reports whether this is the service a user installed for
+// themselves with install --user, whose files go to the XDG directories
+// instead of /etc, /var/run and /var/log. The daemon has USER_SCOPE_ENV
+// from its unit; the CLI tells from the manifest install --user left in
+// the user's state directory. A system daemon running as service.user
+// has neither, and finds the same files as root does.
+func UserScope() bool {
+	if runtime.GOOS == "windows" {
+		return false
+	}
+	if os.Getenv(USER_SCOPE_ENV) == "1" {
+		return true
+	}
+	if os.Geteuid() == 0 {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(UserStateDir(), APPNAME, "install.json"))
+	return err == nil
+}
+
+// UserStateDir is $XDG_STATE_HOME, by default ~/.local/state, where
+// install --user leaves its manifest and a user's daemon logs.
+func UserStateDir() string {
+	return xdgDir("XDG_STATE_HOME", ".local/state")
+}
+
+// UserConfigDir is $XDG_CONFIG_HOME, by default ~/.config.
+func UserConfigDir() string {
+	return xdgDir("XDG_CONFIG_HOME", ".config")
+}
+
+// xdgDir returns the XDG base directory named by env, or fallback below
+// the home directory when it is not set.
+func xdgDir(env, fallback string) string {
+	if dir := os.Getenv(env); filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(os.Getenv("HOME"), fallback)
+}
+
+// runtimeDir is where a user's daemon keeps its pid and state files.
+// XDG_RUNTIME_DIR is unset e.g. after su, fall back to a private
+// directory in /tmp then.
+func runtimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("%s-%d", APPNAME, os.Getuid()))
+}
+
+// setup points v at the config file and registers the defaults.
+func setup(v *viper.Viper) {
+	v.SetConfigName(CONF_NAME)
+	if UserScope() {
+		v.AddConfigPath(filepath.Join(UserConfigDir(), APPNAME))
+	}
+	v.AddConfigPath(fmt.Sprintf("/etc/%s/", APPNAME))
+	v.AddConfigPath(".")
+
+	v.SetConfigName("config")
+	v.SetConfigType("toml")
+	if file := os.Getenv(CONF_ENV); file != "" {
+		v.SetConfigFile(file)
+	}
+
+	v.SetDefault("msg", "hello")
+	v.SetDefault("greeting", false)
+	v.SetDefault("daemon.listen", DEFAULT_LISTEN)
+	if UserScope() {
+		v.SetDefault("log.logpath", filepath.Join(UserStateDir(), APPNAME))
+		v.SetDefault("daemon.pidfile", filepath.Join(runtimeDir(), APPNAME+".pid"))
+		v.SetDefault("daemon.statefile", filepath.Join(runtimeDir(), APPNAME+".state"))
+		v.SetDefault("daemon.control_socket", filepath.Join(runtimeDir(), APPNAME+".control.sock"))
+	} else {
+		v.SetDefault("log.logpath", fmt.Sprintf("/var/log/%s", APPNAME))
+		// a directory of its own, so a daemon running as service.user
+		// can write there
+		v.SetDefault("daemon.pidfile", fmt.Sprintf("/var/run/%s/%s.pid", APPNAME, APPNAME))
+		v.SetDefault("daemon.statefile", fmt.Sprintf("/var/run/%s/%s.state", APPNAME, APPNAME))
+		v.SetDefault("daemon.control_socket", fmt.Sprintf("/run/%s/control.sock", APPNAME))
+	}
+	v.SetDefault("log.level", "info")
+	v.SetDefault("daemon.drain_timeout", "10s")
+	v.SetDefault("daemon.upgrade_timeout", "30s")
+	v.SetDefault("daemon.socket_activation", false)
+	v.SetDefault("daemon.max_connections", 0)
+
+	v.SetDefault("sandbox.seccomp", false)
+	v.SetDefault("sandbox.action", "log")
+	v.SetDefault("sandbox.notify", false)
+	v.SetDefault("sandbox.landlock", false)
+
+	v.SetDefault("exec.restart", "on-failure")
+	v.SetDefault("exec.restart_sec", "1s")
+	v.SetDefault("exec.max_restarts", 5)
+	v.SetDefault("exec.restart_period", "1m")
+	v.SetDefault("exec.stop_signal", "TERM")
+	v.SetDefault("exec.reload_signal", "HUP")
+
+	v.SetDefault("service.restart", "on-failure")
+	v.SetDefault("service.restart_sec", "5s")
+	v.SetDefault("service.working_directory", "/")
+
+	v.SetDefault("install.bin_dir", "/usr/local/bin")
+}
+
+// Current returns the settings loaded by SetDefault.
+func Current() *Config {
+	return fromViper(viper.GetViper())
+}
+
+// Load reads the config file again into a new Config and validates it.
+// The settings returned by Current are left alone, so a bad file can be
+// rejected without touching what the daemon is running with.
+func Load() (*Config, error) {
+	v := viper.New()
+	setup(v)
+	if used := viper.ConfigFileUsed(); used != "" {
+		v.SetConfigFile(used)
+	}
+	if err := v.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			return nil, fmt.Errorf("could not read config: %v", err)
+		}
+	}
+	c := fromViper(v)
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func fromViper(v *viper.Viper) *Config {
+	c := &Config{
+		Name:           APPNAME,
+		Msg:            v.GetString("msg"),
+		Greeting:       v.GetBool("greeting"),
+		LogPath:        v.GetString("log.logpath"),
+		LogLevel:       v.GetString("log.level"),
+		Listen:         v.GetString("daemon.listen"),
+		PidFile:        v.GetString("daemon.pidfile"),
+		StateFile:      v.GetString("daemon.statefile"),
+		ControlSocket:  v.GetString("daemon.control_socket"),
+		DrainTimeout:   v.GetDuration("daemon.drain_timeout"),
+		UpgradeTimeout: v.GetDuration("daemon.upgrade_timeout"),
+		User:           v.GetString("daemon.user"),
+		Group:          v.GetString("daemon.group"),
+		KeepNetBind:    v.GetBool("daemon.keep_net_bind_service"),
+		Seccomp:        v.GetBool("sandbox.seccomp"),
+		SeccompAction:  v.GetString("sandbox.action"),
+		SeccompNotify:  v.GetBool("sandbox.notify"),
+		Landlock:       v.GetBool("sandbox.landlock"),
+		MaxConnections: v.GetInt("daemon.max_connections"),
+		File:           v.ConfigFileUsed(),
+		Exec: Exec{
+			Command:          v.GetString("exec.command"),
+			Args:             v.GetStringSlice("exec.args"),
+			Env:              v.GetStringSlice("exec.env"),
+			WorkingDirectory: v.GetString("exec.working_directory"),
+			User:             v.GetString("exec.user"),
+			Group:            v.GetString("exec.group"),
+			Restart:          v.GetString("exec.restart"),
+			RestartSec:       v.GetDuration("exec.restart_sec"),
+			MaxRestarts:      v.GetInt("exec.max_restarts"),
+			RestartPeriod:    v.GetDuration("exec.restart_period"),
+			StopSignal:       v.GetString("exec.stop_signal"),
+			ReloadSignal:     v.GetString("exec.reload_signal"),
+		},
+	}
+	c.Process, c.processErr = processFromViper(v)
+	return c
+}
+
+// processFromViper reads the [process] section. Limits are a number, in
+// bytes for as and core with an optional K, M or G, or "unlimited".
+func processFromViper(v *viper.Viper) (Process, error) {
+	p := Process{Limits: map[string]uint64{}}
+	for _, name := range limitNames {
+		key := "process." + name
+		if !v.IsSet(key) {
+			continue
+		}
+		limit, err := parseLimit(v.GetString(key), name == "as" || name == "core")
+		if err != nil {
+			return p, fmt.Errorf("%s: %v", key, err)
+		}
+		p.Limits[name] = limit
+	}
+	if v.IsSet("process.umask") {
+		umask, err := strconv.ParseUint(v.GetString("process.umask"), 8, 32)
+		if err != nil || umask > 0777 {
+			return p, fmt.Errorf("process.umask must be octal, like \"0022\"")
+		}
+		mask := int(umask)
+		p.Umask = &mask
+	}
+	p.WorkingDirectory = v.GetString("process.working_directory")
+	ints := map[string]**int{"process.oom_score_adj": &p.OOMScoreAdj, "process.nice": &p.Nice}
+	for key, field := range ints {
+		if !v.IsSet(key) {
+			continue
+		}
+		n, err := strconv.Atoi(v.GetString(key))
+		if err != nil {
+			return p, fmt.Errorf("%s: %v", key, err)
+		}
+		*field = &n
+	}
+	return p, nil
+}
+
+// parseLimit parses a resource limit, with a size suffix when bytes is
+// set.
+func parseLimit(s string, bytes bool) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if s == "unlimited" || s == "infinity" {
+		return math.MaxUint64, nil
+	}
+	unit := uint64(1)
+	if bytes && s != "" {
+		switch strings.ToUpper(s[len(s)-1:]) {
+		case "K":
+			unit = 1 << 10
+		case "M":
+			unit = 1 << 20
+		case "G":
+			unit = 1 << 30
+		}
+		if unit > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number or \"unlimited\"", s)
+	}
+	if n > math.MaxUint64/unit {
+		return 0, fmt.Errorf("%q is too large", s)
+	}
+	return n * unit, nil
+}
+
+// Validate checks the settings for values the daemon cannot run with.
+func (this *Config) Validate() error {
+	if _, _, err := net.SplitHostPort(this.Listen); err != nil {
+		return fmt.Errorf("daemon.listen: %v", err)
+	}
+	if this.PidFile == "" {
+		return fmt.Errorf("daemon.pidfile must not be empty")
+	}
+	if this.StateFile == "" {
+		return fmt.Errorf("daemon.statefile must not be empty")
 	}
+	if this.LogLevel != "debug" && this.LogLevel != "info" {
+		return fmt.Errorf("log.level must be debug or info, not %q", this.LogLevel)
+	}
+	if this.DrainTimeout < 0 {
+		return fmt.Errorf("daemon.drain_timeout must not be negative")
+	}
+	if this.UpgradeTimeout <= 0 {
+		return fmt.Errorf("daemon.upgrade_timeout must be positive")
+	}
+	if this.Group != "" && this.User == "" {
+		return fmt.Errorf("daemon.group needs daemon.user")
+	}
+	if this.MaxConnections < 0 {
+		return fmt.Errorf("daemon.max_connections must not be negative")
+	}
+	if this.processErr != nil {
+		return this.processErr
+	}
+	if dir := this.Process.WorkingDirectory; dir != "" && !filepath.IsAbs(dir) {
+		return fmt.Errorf("process.working_directory must be an absolute path")
+	}
+	if adj := this.Process.OOMScoreAdj; adj != nil && (*adj < -1000 || *adj > 1000) {
+		return fmt.Errorf("process.oom_score_adj must be between -1000 and 1000")
+	}
+	if nice := this.Process.Nice; nice != nil && (*nice < -20 || *nice > 19) {
+		return fmt.Errorf("process.nice must be between -20 and 19")
+	}
+	if this.SeccompAction != "log" && this.SeccompAction != "deny" {
+		return fmt.Errorf("sandbox.action must be log or deny, not %q", this.SeccompAction)
+	}
+	if this.Exec.Command != "" {
+		return this.validateExec()
+	}
+	return nil
+}
+
+// validateExec checks the [exec] section, and the settings that do not
+// go with it.
+func (this *Config) validateExec() error {
+	e := &this.Exec
+	if e.Restart != "always" && e.Restart != "on-failure" {
+		return fmt.Errorf("exec.restart must be always or on-failure, not %q", e.Restart)
+	}
+	if e.RestartSec <= 0 || e.RestartPeriod <= 0 || e.MaxRestarts <= 0 {
+		return fmt.Errorf("exec.restart_sec, exec.max_restarts and exec.restart_period must be positive")
+	}
+	for _, kv := range e.Env {
+		if !strings.Contains(kv, "=") {
+			return fmt.Errorf("exec.env: %q is not KEY=value", kv)
+		}
+	}
+	if dir := e.WorkingDirectory; dir != "" && !filepath.IsAbs(dir) {
+		return fmt.Errorf("exec.working_directory must be an absolute path")
+	}
+	if e.Group != "" && e.User == "" {
+		return fmt.Errorf("exec.group needs exec.user")
+	}
+	if e.User != "" && this.User != "" {
+		// the daemon cannot switch accounts once it dropped to one
+		return fmt.Errorf("exec.user needs the daemon to run as root, leave daemon.user empty")
+	}
+	if !isSignalName(e.StopSignal) {
+		return fmt.Errorf("exec.stop_signal must be one of %v, not %q", SignalNames, e.StopSignal)
+	}
+	if e.ReloadSignal != "" && !isSignalName(e.ReloadSignal) {
+		return fmt.Errorf("exec.reload_signal must be empty or one of %v, not %q", SignalNames, e.ReloadSignal)
+	}
+	if this.Seccomp || this.Landlock {
+		// neither lets the daemon start another program
+		return fmt.Errorf("[sandbox] cannot confine a daemon that runs exec.command")
+	}
+	return nil
+}
+
+func isSignalName(name string) bool {
+	for _, n := range SignalNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteDirs are the directories the daemon writes to: those of its log,
+// pid and state files and its control socket.
+func (this *Config) WriteDirs() []string {
+	var dirs []string
+	seen := map[string]bool{}
+	for _, path := range []string{this.LogFile(), this.PidFile, this.StateFile, this.ControlSocket} {
+		if path == "" {
+			continue
+		}
+		if dir := filepath.Dir(path); !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// LogFile returns the file the daemon logs to, inside log.logpath.
+func (this *Config) LogFile() string {
+	if this.LogPath == "" {
+		return filepath.Join("/var/log", APPNAME+".log")
+	}
+	return filepath.Join(this.LogPath, APPNAME+".log")
+}
 
-	viper.SetDefault("msg", "hello")
+// Diff lists the settings that differ from old, split into those the
+// daemon can apply while running and those that need a restart.
+func (this *Config) Diff(old *Config) (live, restart []string) {
+	if this.Msg != old.Msg {
+		live = append(live, "msg")
+	}
+	if this.Greeting != old.Greeting {
+		live = append(live, "greeting")
+	}
+	if this.LogPath != old.LogPath {
+		live = append(live, "log.logpath")
+	}
+	if this.LogLevel != old.LogLevel {
+		live = append(live, "log.level")
+	}
+	if this.Listen != old.Listen {
+		live = append(live, "daemon.listen")
+	}
+	if this.DrainTimeout != old.DrainTimeout {
+		live = append(live, "daemon.drain_timeout")
+	}
+	if this.UpgradeTimeout != old.UpgradeTimeout {
+		live = append(live, "daemon.upgrade_timeout")
+	}
+	if this.MaxConnections != old.MaxConnections {
+		live = append(live, "daemon.max_connections")
+	}
+	if this.PidFile != old.PidFile {
+		restart = append(restart, "daemon.pidfile")
+	}
+	if this.StateFile != old.StateFile {
+		restart = append(restart, "daemon.statefile")
+	}
+	if this.ControlSocket != old.ControlSocket {
+		restart = append(restart, "daemon.control_socket")
+	}
+	if this.User != old.User {
+		restart = append(restart, "daemon.user")
+	}
+	if this.Group != old.Group {
+		restart = append(restart, "daemon.group")
+	}
+	if this.KeepNetBind != old.KeepNetBind {
+		restart = append(restart, "daemon.keep_net_bind_service")
+	}
+	if this.Seccomp != old.Seccomp {
+		restart = append(restart, "sandbox.seccomp")
+	}
+	if this.SeccompAction != old.SeccompAction {
+		restart = append(restart, "sandbox.action")
+	}
+	if this.SeccompNotify != old.SeccompNotify {
+		restart = append(restart, "sandbox.notify")
+	}
+	if this.Landlock != old.Landlock {
+		restart = append(restart, "sandbox.landlock")
+	}
+	restart = append(restart, this.Process.diff(old.Process)...)
+	return live, append(restart, this.Exec.diff(old.Exec)...)
+}
 
+// diff lists the [exec] settings that differ from old. The child is
+// started with them, so they all need a restart.
+func (this Exec) diff(old Exec) []string {
+	var changed []string
+	sameStrings := func(a, b []string) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+	fields := []struct {
+		key  string
+		same bool
+	}{
+		{"exec.command", this.Command == old.Command},
+		{"exec.args", sameStrings(this.Args, old.Args)},
+		{"exec.env", sameStrings(this.Env, old.Env)},
+		{"exec.working_directory", this.WorkingDirectory == old.WorkingDirectory},
+		{"exec.user", this.User == old.User},
+		{"exec.group", this.Group == old.Group},
+		{"exec.restart", this.Restart == old.Restart},
+		{"exec.restart_sec", this.RestartSec == old.RestartSec},
+		{"exec.max_restarts", this.MaxRestarts == old.MaxRestarts},
+		{"exec.restart_period", this.RestartPeriod == old.RestartPeriod},
+		{"exec.stop_signal", this.StopSignal == old.StopSignal},
+		{"exec.reload_signal", this.ReloadSignal == old.ReloadSignal},
+	}
+	for _, f := range fields {
+		if !f.same {
+			changed = append(changed, f.key)
+		}
+	}
+	return changed
+}
+
+// diff lists the [process] settings that differ from old.
+func (this Process) diff(old Process) []string {
+	var changed []string
+	for _, name := range limitNames {
+		limit, set := this.Limits[name]
+		oldLimit, oldSet := old.Limits[name]
+		if set != oldSet || limit != oldLimit {
+			changed = append(changed, "process."+name)
+		}
+	}
+	sameInt := func(a, b *int) bool {
+		return a == nil && b == nil || a != nil && b != nil && *a == *b
+	}
+	if !sameInt(this.Umask, old.Umask) {
+		changed = append(changed, "process.umask")
+	}
+	if this.WorkingDirectory != old.WorkingDirectory {
+		changed = append(changed, "process.working_directory")
+	}
+	if !sameInt(this.OOMScoreAdj, old.OOMScoreAdj) {
+		changed = append(changed, "process.oom_score_adj")
+	}
+	if !sameInt(this.Nice, old.Nice) {
+		changed = append(changed, "process.nice")
+	}
+	return changed
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/oliveagle/ole_tryout_daemon/config"
+	"github.com/oliveagle/ole_tryout_daemon/servicelib"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// echo is the example Program: it answers each line with the time it
+// arrived, greeting with msg first when greeting is set.
+type echo struct {
+	*servicelib.Supervisor
+
+	mu     sync.Mutex
+	msg    string
+	greet  bool
+	paused bool
+	// lines answered since stats last logged them
+	lines int
+}
+
+func newEcho() *echo {
+	this := &echo{}
+	this.Supervisor = servicelib.NewSupervisor(
+		&servicelib.Component{Name: "stats", Run: this.stats},
+	)
+	return this
+}
+
+func (this *echo) Start(ctx context.Context) error {
+	this.mu.Lock()
+	cfg := config.Current()
+	this.msg, this.greet = cfg.Msg, cfg.Greeting
+	this.mu.Unlock()
+	log.Print("echo: started\r\n")
+	return this.Supervisor.Start(ctx)
+}
+
+// Stop stops the background work, the daemon drains the clients.
+func (this *echo) Stop(ctx context.Context) error {
+	log.Print("echo: stopped\r\n")
+	return this.Supervisor.Stop(ctx)
+}
+
+func (this *echo) Pause() error {
+	if err := this.Supervisor.Pause(); err != nil {
+		return err
+	}
+	this.mu.Lock()
+	this.paused = true
+	this.mu.Unlock()
+	return nil
+}
+
+func (this *echo) Continue() error {
+	if err := this.Supervisor.Continue(); err != nil {
+		return err
+	}
+	this.mu.Lock()
+	this.paused = false
+	this.mu.Unlock()
+	return nil
+}
+
+func (this *echo) Reload(cfg *config.Config) error {
+	if err := this.Supervisor.Reload(cfg); err != nil {
+		return err
+	}
+	this.mu.Lock()
+	this.msg, this.greet = cfg.Msg, cfg.Greeting
+	this.mu.Unlock()
+	return nil
+}
+
+// stats logs how many lines the clients sent, once a minute.
+func (this *echo) stats(ctx context.Context) error {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		this.mu.Lock()
+		lines := this.lines
+		this.lines = 0
+		this.mu.Unlock()
+		if lines > 0 {
+			log.Printf("echo: answered %d lines in the last minute\r\n", lines)
+		}
+	}
+}
+
+// greeting returns what to greet a client with, empty for nothing.
+func (this *echo) greeting() string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if !this.greet {
+		return ""
+	}
+	return this.msg
+}
+
+func (this *echo) isPaused() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.paused
+}
+
+func (this *echo) ServeConn(ctx context.Context, client net.Conn) {
+	if msg := this.greeting(); msg != "" {
+		client.Write([]byte(msg + "\r\n"))
+	}
+
+	for {
+		buf := make([]byte, 4096)
+		numbytes, err := client.Read(buf)
+		servicelib.Debugf("echo: %s numbytes: %d, err: %v, buf: %v\r\n",
+			client.RemoteAddr(), numbytes, err, buf[:numbytes])
+		if numbytes == 0 || err != nil {
+			// EOF, close connection
+			return
+		}
+		if numbytes == 2 && buf[0] == 13 && buf[1] == 10 {
+			// [13 10]  "\r\n"
+		} else if this.isPaused() {
+			client.Write([]byte("service paused\r\n"))
+		} else {
+			this.mu.Lock()
+			this.lines++
+			this.mu.Unlock()
+			now := time.Now()
+			str := fmt.Sprintf("%s: %s\r\n", now.Local().Format("15:04:05.999999999"), buf)
+			client.Write([]byte(str))
+		}
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/oliveagle/ole_tryout_daemon/config"
 	"github.com/oliveagle/ole_tryout_daemon/servicelib"
 	// "github.com/spf13/viper"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -14,58 +16,157 @@ const (
 	version = "v0.0.1"
 	svcName = "oleservice"
 	svcDesc = "ole service description"
-	port    = ":9977"
 )
 
+// logFile is where the log goes, unless we run in the foreground.
+var logFile *os.File
+
 func usage(errmsg string) {
 	fmt.Fprintf(os.Stderr,
 		"%s\n\n"+
 			"usage: %s <command>\n"+
 			"       where <command> is one of\n"+
-			"       install, remove, status, start, stop, pause or continue.\n",
+			"       install, remove, status, start, stop, pause, continue,\n"+
+			"       reload, upgrade, drain, connections, log-level, dump,\n"+
+			"       doctor, run or debug.\n"+
+			"\n"+
+			"       run [--foreground]  run the daemon in this process; with\n"+
+			"                           --foreground it logs to stderr and\n"+
+			"                           stops cleanly on Ctrl-C.\n"+
+			"       debug               same as run --foreground.\n"+
+			"       install [--print] [--user [--linger]] [--root=DIR] [--dry-run]\n"+
+			"                           install the service; --print shows the\n"+
+			"                           files it would write instead. --user\n"+
+			"                           installs a systemd user unit, no root\n"+
+			"                           needed. --root stages the files below\n"+
+			"                           DIR; --dry-run prints the manifest of\n"+
+			"                           files and commands instead.\n"+
+			"       remove [--user] [--root=DIR] [--dry-run] [--purge]\n"+
+			"                           undo what install recorded in its\n"+
+			"                           manifest; --purge deletes the config,\n"+
+			"                           logs, state and service account too.\n"+
+			"       start [--detach]    start the service; --detach runs it in\n"+
+			"                           the background without an init system\n"+
+			"                           and returns once it serves.\n"+
+			"       reload              re-read config.toml in the running daemon.\n"+
+			"       upgrade             hand the listener to a new copy of the\n"+
+			"                           binary without dropping connections.\n"+
+			"       status [--json]  exits 0 running, 1 dead with pid file,\n"+
+			"                        3 not running, 4 unknown.\n"+
+			"       drain [--timeout=D]\n"+
+			"                        stop accepting and wait up to D for\n"+
+			"                        the open connections to finish; the\n"+
+			"                        daemon stays paused until continue.\n"+
+			"       connections [--json]\n"+
+			"                        list the connected clients.\n"+
+			"       log-level [debug|info]\n"+
+			"                        show or change the running daemon's\n"+
+			"                        log level.\n"+
+			"       dump             print the daemon's goroutine stacks.\n"+
+			"       doctor           report the kernel features [sandbox]\n"+
+			"                        can use.\n"+
+			"\n"+
+			"       status, pause, continue and reload ask the daemon on its\n"+
+			"       control socket, and fall back to signals and the init\n"+
+			"       system when it does not answer there; drain, connections,\n"+
+			"       log-level and dump need the socket.\n"+
+			"\n"+
+			"       --backend=NAME  manage the service through systemd, openrc,\n"+
+			"                       runit, s6, sysv, launchd or nohup instead\n"+
+			"                       of the detected init system.\n",
 		errmsg, os.Args[0])
 	os.Exit(2)
 }
 
 func main() {
+	var backend string
+	backend, os.Args = backendFlag(os.Args)
+
+	cmd := ""
+	if len(os.Args) >= 2 {
+		cmd = strings.ToLower(os.Args[1])
+	}
+
+	foreground := cmd == "debug"
+	if cmd == "run" {
+		flags := flag.NewFlagSet("run", flag.ExitOnError)
+		flags.BoolVar(&foreground, "foreground", false, "stay attached and log to stderr")
+		flags.Parse(os.Args[2:])
+	}
+
+	// install --user sets up the user's own service, with its files
+	// where the user's daemon looks for them
+	if (cmd == "install" || cmd == "remove") && hasFlag(os.Args[2:], "user") {
+		os.Setenv(config.USER_SCOPE_ENV, "1")
+	}
+
+	config.SetDefault()
+
 	// - log --------------------
-	f, err := os.OpenFile(getLogFilePath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		fmt.Printf("error opening file: %v \n", err)
+	if foreground {
+		log.SetOutput(os.Stderr)
+	} else {
+		f, err := openLogFile(getLogFilePath())
+		if err != nil {
+			fmt.Printf("error opening file: %v \n", err)
+		}
+		swapLogFile(f)
+		defer func() { logFile.Close() }()
 	}
-	defer f.Close()
-	log.SetOutput(f)
 	// -------------------- log -
 
-	config.SetDefault()
+	var err error
 
-	srv := servicelib.NewService(svcName, svcDesc)
+	srv := servicelib.NewService(svcName, svcDesc, newProgram())
+	srv.Version = version
+	srv.Backend = backend
 
-	if len(os.Args) >= 2 {
-		log.Println("new func main\r\n")
+	if cmd != "" {
+		log.Print("new func main\r\n")
 
-		cmd := strings.ToLower(os.Args[1])
 		switch cmd {
 		case "install":
-			err = srv.InstallService()
+			err = install(srv, os.Args[2:])
 		case "remove":
-			err = srv.RemoveService()
+			err = remove(srv, os.Args[2:])
 		case "start":
-			err = srv.StartService()
+			err = start(srv, os.Args[2:])
 		case "stop":
 			err = srv.StopService()
 		case "pause":
 			err = srv.PauseService()
 		case "continue":
 			err = srv.ContinueService()
+		case "reload":
+			err = srv.ReloadService()
+		case "upgrade":
+			err = srv.UpgradeService()
 		case "status":
-			err = srv.Status()
+			os.Exit(status(srv, os.Args[2:]))
+		case "drain":
+			err = drain(srv, os.Args[2:])
+		case "connections", "conns":
+			err = connections(srv, os.Args[2:])
+		case "log-level":
+			level := ""
+			if len(os.Args) > 2 {
+				level = os.Args[2]
+			}
+			err = srv.ChangeLogLevel(level)
+		case "dump":
+			err = srv.DumpGoroutines(os.Stdout)
 		case "config":
 			err = srv.Config()
+		case "doctor":
+			doctor()
+		case "run", "debug":
+			run(srv, foreground)
+			return
 		default:
 			usage(fmt.Sprintf("invalid command %s", cmd))
 		}
 		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to %s %s: %v\n", cmd, svcName, err)
 			log.Fatalf("failed to %s %s: %v", cmd, svcName, err)
 		}
 	} else {
@@ -74,11 +175,180 @@ func main() {
 			log.Fatalf("failed to determine if we are running in an interactive session: %v", err)
 		}
 		if !isIntSess {
-			runService(svcName, false)
+			run(srv, false)
 			return
 		}
-		// runService(svcName, false)
+		usage("no command specified")
 	}
 
 	return
 }
+
+// backendFlag takes --backend=NAME or --backend NAME out of args, as it
+// applies to every command.
+func backendFlag(args []string) (string, []string) {
+	backend := ""
+	rest := []string{args[0]}
+	for i := 1; i < len(args); i++ {
+		switch {
+		case strings.HasPrefix(args[i], "--backend="):
+			backend = strings.TrimPrefix(args[i], "--backend=")
+		case args[i] == "--backend" && i+1 < len(args):
+			backend = args[i+1]
+			i++
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	return backend, rest
+}
+
+// hasFlag reports whether the boolean flag name is set in args, before
+// the command parses them.
+func hasFlag(args []string, name string) bool {
+	for _, arg := range args {
+		switch strings.TrimLeft(arg, "-") {
+		case name, name + "=true", name + "=1":
+			return strings.HasPrefix(arg, "-")
+		}
+	}
+	return false
+}
+
+func openLogFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+}
+
+// swapLogFile points the log at f and closes the file it used before.
+func swapLogFile(f *os.File) {
+	old := logFile
+	logFile = f
+	log.SetOutput(f)
+	if old != nil {
+		old.Close()
+	}
+}
+
+// newProgram returns what the daemon runs: the program in [exec], or
+// else the echo server.
+func newProgram() servicelib.Program {
+	if cfg := config.Current(); cfg.Exec.Command != "" {
+		return servicelib.NewExec(cfg.Exec)
+	}
+	return newEcho()
+}
+
+// run runs the daemon in this process until it is told to stop.
+func run(srv *servicelib.Service, isDebug bool) {
+	status, err := runService(svcName, srv.Program(), isDebug)
+	if err != nil {
+		// a parent waiting for us to take over wants to know why we can't
+		servicelib.NotifyParent(fmt.Errorf("%s: %v", status, err))
+		if !isDebug {
+			// the log went to the log file, make sure the caller sees it
+			fmt.Fprintf(os.Stderr, "%s: %v\n", status, err)
+		}
+		log.Fatalf("%s: %v", status, err)
+	}
+	log.Println(status)
+}
+
+// install installs the service, or with --print only shows what it
+// would write.
+func install(srv *servicelib.Service, args []string) error {
+	flags := flag.NewFlagSet("install", flag.ExitOnError)
+	print := flags.Bool("print", false, "print the unit instead of installing it")
+	userUnit := flags.Bool("user", false, "install a systemd unit for the current user, no root needed")
+	flags.BoolVar(&srv.Linger, "linger", false, "with --user, keep the service running after logout")
+	flags.StringVar(&srv.Root, "root", "", "stage the files below `dir` instead, running no init system commands")
+	flags.BoolVar(&srv.DryRun, "dry-run", false, "print the install manifest instead of installing")
+	flags.Parse(args)
+
+	if *userUnit {
+		srv.Backend = "systemd-user"
+	}
+
+	if *print {
+		return srv.PrintServiceUnit(os.Stdout)
+	}
+	return srv.InstallService()
+}
+
+// start starts the service through the init system, or with --detach
+// runs it in the background itself.
+func start(srv *servicelib.Service, args []string) error {
+	flags := flag.NewFlagSet("start", flag.ExitOnError)
+	flags.BoolVar(&srv.Detach, "detach", false, "daemonize without an init system")
+	flags.Parse(args)
+	return srv.StartService()
+}
+
+// remove undoes an install, or one staged with --root.
+func remove(srv *servicelib.Service, args []string) error {
+	flags := flag.NewFlagSet("remove", flag.ExitOnError)
+	userUnit := flags.Bool("user", false, "remove the systemd unit of the current user")
+	flags.StringVar(&srv.Root, "root", "", "remove what install staged below `dir`")
+	flags.BoolVar(&srv.DryRun, "dry-run", false, "print the manifest of what would be removed")
+	flags.BoolVar(&srv.Purge, "purge", false, "delete the config, logs, state and service account too")
+	flags.Parse(args)
+
+	if *userUnit {
+		srv.Backend = "systemd-user"
+	}
+	return srv.RemoveService()
+}
+
+// drain pauses the daemon and waits for its clients to finish.
+func drain(srv *servicelib.Service, args []string) error {
+	flags := flag.NewFlagSet("drain", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 0, "how long to wait, daemon.drain_timeout when 0")
+	flags.Parse(args)
+	return srv.DrainService(*timeout)
+}
+
+// connections lists the clients the daemon serves.
+func connections(srv *servicelib.Service, args []string) error {
+	flags := flag.NewFlagSet("connections", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the connections as JSON")
+	flags.Parse(args)
+	return srv.ListConnections(os.Stdout, *asJSON)
+}
+
+// doctor prints which kernel features the sandbox can use here.
+func doctor() {
+	features := servicelib.KernelFeatures()
+	if len(features) == 0 {
+		fmt.Println("the sandbox is not supported here")
+		return
+	}
+	for _, f := range features {
+		available := "no"
+		if f.Available {
+			available = "yes"
+		}
+		fmt.Printf("%-14s %-4s %s\n", f.Name+":", available, f.Detail)
+	}
+}
+
+// status prints the service status and returns the LSB exit code.
+func status(srv *servicelib.Service, args []string) int {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the status as JSON")
+	flags.Parse(args)
+
+	st, err := srv.Status()
+	if err != nil {
+		log.Printf("failed to status %s: %v", svcName, err)
+		fmt.Fprintf(os.Stderr, "failed to status %s: %v\n", svcName, err)
+		return servicelib.LSBUnknown
+	}
+	if *asJSON {
+		st.WriteJSON(os.Stdout)
+	} else {
+		st.WriteText(os.Stdout)
+	}
+	return st.ExitCode()
+}
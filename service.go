@@ -3,53 +3,727 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
 	"syscall"
 
 	// "bytes"
 	"time"
 	// "github.com/takama/daemon"
+	"github.com/oliveagle/ole_tryout_daemon/config"
+	"github.com/oliveagle/ole_tryout_daemon/servicelib"
 )
 
 func getLogFilePath() string {
-	return "/var/log/myservice.log"
+	return config.Current().LogFile()
 }
 
-func acceptConnection(listener net.Listener, listen chan<- net.Conn) {
+// server holds the state shared by the accept loop, the client handlers,
+// the control socket and the signal loop in runService, which drive the
+// program through it.
+type server struct {
+	program servicelib.Program
+	// handler is the program, when it serves clients
+	handler servicelib.ConnHandler
+	// ctx is what the program runs with, cancelled once it stops
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	started   time.Time
+	reopenLog bool
+	activated bool
+	identity  *servicelib.Identity
+	process   *servicelib.ProcessInfo
+	listen    chan net.Conn
+	// calls are control requests for the signal loop to carry out; it
+	// closes stopped when it returns
+	calls   chan func()
+	stopped chan struct{}
+
+	mu         sync.Mutex
+	cfg        *config.Config
+	listeners  []net.Listener
+	lastReload *servicelib.ReloadReport
+	upgrade    *servicelib.UpgradeReport
+	paused     bool
+	closing    bool
+	full       bool
+	acceptErr  time.Time
+	resume     chan struct{}
+	ctl        *servicelib.ControlListener
+	clients    map[net.Conn]time.Time // and since when
+	handlers   sync.WaitGroup
+}
+
+func newServer(program servicelib.Program, listeners []net.Listener, cfg *config.Config) *server {
+	handler, _ := program.(servicelib.ConnHandler)
+	ctx, cancel := context.WithCancel(context.Background())
+	return &server{
+		program:   program,
+		handler:   handler,
+		ctx:       ctx,
+		cancel:    cancel,
+		started:   time.Now(),
+		identity:  servicelib.CurrentIdentity(),
+		process:   servicelib.CurrentProcess(),
+		listen:    make(chan net.Conn, 100),
+		calls:     make(chan func()),
+		stopped:   make(chan struct{}),
+		cfg:       cfg,
+		listeners: listeners,
+		clients:   make(map[net.Conn]time.Time),
+	}
+}
+
+func (this *server) config() *config.Config {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.cfg
+}
+
+func (this *server) currentListeners() []net.Listener {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return append([]net.Listener(nil), this.listeners...)
+}
+
+func (this *server) isCurrent(listener net.Listener) bool {
+	for _, l := range this.currentListeners() {
+		if l == listener {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *server) addrs() []string {
+	var addrs []string
+	for _, l := range this.currentListeners() {
+		addrs = append(addrs, l.Addr().String())
+	}
+	return addrs
+}
+
+// publish writes the current state for the status command.
+func (this *server) publish() {
+	state := servicelib.StateRunning
+	if this.isPaused() {
+		state = servicelib.StatePaused
+	}
+	this.writeState(state, nil)
+	this.notifyStatus()
+}
+
+// notify passes state on to systemd, when it started us.
+func notify(state string) {
+	if err := servicelib.SdNotify(state); err != nil {
+		log.Printf("notify: %v\r\n", err)
+	}
+}
+
+// notifyStatus updates the status line systemctl status shows.
+func (this *server) notifyStatus() {
+	this.mu.Lock()
+	closing, paused, n := this.closing, this.paused, len(this.clients)
+	this.mu.Unlock()
+	if closing {
+		return
+	}
+	if this.handler == nil {
+		if paused {
+			notify("STATUS=Paused")
+		} else {
+			notify("STATUS=Running")
+		}
+		return
+	}
+	if paused {
+		notify(fmt.Sprintf("STATUS=Paused, %d connections", n))
+		return
+	}
+	notify(fmt.Sprintf("STATUS=Serving %d connections on %s", n, strings.Join(this.addrs(), ", ")))
+}
+
+// acceptHealthy reports whether the accept loops have gone without
+// errors for a while. Taking the lock also shows it is not stuck.
+func (this *server) acceptHealthy() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	// acceptConnection backs off for a second at most, so a loop that
+	// keeps failing refreshes acceptErr well within this
+	return time.Since(this.acceptErr) > 2*time.Second
+}
+
+func (this *server) acceptFailed() {
+	this.mu.Lock()
+	this.acceptErr = time.Now()
+	this.mu.Unlock()
+}
+
+// publishShutdown leaves the drain counts behind for the stop command,
+// and what the program failed with for status.
+func (this *server) publishShutdown(drained, killed int, failure error) {
+	report := &servicelib.ShutdownReport{Drained: drained, Killed: killed}
+	if failure != nil {
+		report.Error = failure.Error()
+	}
+	this.writeState(servicelib.StateStopped, report)
+}
+
+func (this *server) writeState(state string, report *servicelib.ShutdownReport) {
+	path := this.config().StateFile
+	if err := servicelib.WriteStateFile(path, this.daemonState(state, report)); err != nil {
+		log.Printf("publish: could not write state file %s: %v\r\n", path, err)
+	}
+}
+
+func (this *server) daemonState(state string, report *servicelib.ShutdownReport) *servicelib.DaemonState {
+	addrs := this.addrs()
+	var components []servicelib.ComponentState
+	if reporter, ok := this.program.(servicelib.ComponentReporter); ok {
+		components = reporter.Components()
+	}
+	var child *servicelib.ChildState
+	if reporter, ok := this.program.(servicelib.ChildReporter); ok {
+		child = reporter.Child()
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return &servicelib.DaemonState{
+		Pid:        os.Getpid(),
+		State:      state,
+		Started:    this.started,
+		Listen:     addrs,
+		Version:    version,
+		Shutdown:   report,
+		Reload:     this.lastReload,
+		Upgrade:    this.upgrade,
+		Identity:   this.identity,
+		Process:    this.process,
+		Components: components,
+		Child:      child,
+	}
+}
+
+// upgradeFailed records why the new process could not take over, and
+// takes back the control socket should it have replaced ours already.
+func (this *server) upgradeFailed(err error) {
+	this.mu.Lock()
+	this.upgrade = &servicelib.UpgradeReport{Time: time.Now(), Error: err.Error()}
+	ctl := this.ctl
+	this.mu.Unlock()
+	if ctl != nil && !ctl.Owned() {
+		ctl.Close()
+		if err := this.listenControl(ctl.Path()); err != nil {
+			log.Printf("runService: could not take back the control socket: %v\r\n", err)
+		}
+	}
+	this.publish()
+}
+
+// listenControl answers requests on the control socket at path.
+func (this *server) listenControl(path string) error {
+	ctl, err := servicelib.ListenControl(path)
+	if err != nil {
+		return err
+	}
+	this.mu.Lock()
+	this.ctl = ctl
+	this.mu.Unlock()
+	go ctl.Serve(this.control)
+	return nil
+}
+
+func (this *server) closeControl() {
+	this.mu.Lock()
+	ctl := this.ctl
+	this.ctl = nil
+	this.mu.Unlock()
+	if ctl != nil {
+		ctl.Close()
+	}
+}
+
+// do runs call in the signal loop, like a signal that asks for the same,
+// and returns its error. The loop no longer runs once the daemon stops.
+func (this *server) do(call func() error) error {
+	result := make(chan error, 1)
+	select {
+	case this.calls <- func() { result <- call() }:
+	case <-this.stopped:
+		return fmt.Errorf("%s is shutting down", svcName)
+	}
+	return <-result
+}
+
+// control answers a request on the control socket.
+func (this *server) control(req *servicelib.ControlRequest) *servicelib.ControlResponse {
+	switch req.Command {
+	case servicelib.ControlStatus:
+		state := servicelib.StateRunning
+		if this.isPaused() {
+			state = servicelib.StatePaused
+		}
+		return &servicelib.ControlResponse{State: this.daemonState(state, nil)}
+	case servicelib.ControlPause:
+		if err := this.do(this.pause); err != nil {
+			return servicelib.ControlError(err)
+		}
+		return &servicelib.ControlResponse{}
+	case servicelib.ControlContinue:
+		if err := this.do(this.cont); err != nil {
+			return servicelib.ControlError(err)
+		}
+		return &servicelib.ControlResponse{}
+	case servicelib.ControlReload:
+		// a rejected config is in the report
+		if err := this.do(func() error { this.reload(); return nil }); err != nil {
+			return servicelib.ControlError(err)
+		}
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		return &servicelib.ControlResponse{Reload: this.lastReload}
+	case servicelib.ControlDrain:
+		timeout := this.config().DrainTimeout
+		if req.Timeout != "" {
+			d, err := time.ParseDuration(req.Timeout)
+			if err != nil || d < 0 {
+				return servicelib.ControlError(fmt.Errorf("bad drain timeout %q", req.Timeout))
+			}
+			timeout = d
+		}
+		if err := this.do(this.pause); err != nil {
+			return servicelib.ControlError(err)
+		}
+		return &servicelib.ControlResponse{Drain: this.drain(timeout)}
+	case servicelib.ControlConnections:
+		return &servicelib.ControlResponse{Connections: this.connections()}
+	case servicelib.ControlLogLevel:
+		if req.Level != "" {
+			if err := servicelib.SetLogLevel(req.Level); err != nil {
+				return servicelib.ControlError(err)
+			}
+			log.Printf("control: log level is %s now\r\n", req.Level)
+		}
+		return &servicelib.ControlResponse{LogLevel: servicelib.LogLevel()}
+	case servicelib.ControlDump:
+		var buf strings.Builder
+		pprof.Lookup("goroutine").WriteTo(&buf, 2)
+		return &servicelib.ControlResponse{Dump: buf.String()}
+	}
+	return servicelib.ControlError(fmt.Errorf("unknown command %q", req.Command))
+}
+
+// drain waits up to timeout for the clients of a paused server to
+// leave. Unlike shutdown it neither tells them nor closes anything.
+func (this *server) drain(timeout time.Duration) *servicelib.DrainReport {
+	open := len(this.clientList())
+	deadline := time.Now().Add(timeout)
 	for {
+		left := len(this.clientList())
+		if left == 0 || time.Now().After(deadline) {
+			log.Printf("drain: %d connections drained, %d still open\r\n", open-left, left)
+			return &servicelib.DrainReport{Drained: open - left, Open: left}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// connections lists the clients, the longest connected first.
+func (this *server) connections() []servicelib.Connection {
+	this.mu.Lock()
+	conns := make([]servicelib.Connection, 0, len(this.clients))
+	for client, since := range this.clients {
+		conns = append(conns, servicelib.Connection{
+			Remote: client.RemoteAddr().String(),
+			Local:  client.LocalAddr().String(),
+			Since:  since,
+		})
+	}
+	this.mu.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Since.Before(conns[j].Since) })
+	return conns
+}
+
+// reload re-reads the config file and applies it as a whole or not at
+// all. Everything that can fail, binding a new listen address, opening
+// the log file and the program taking on the config, is done before any
+// setting changes.
+func (this *server) reload() {
+	report := &servicelib.ReloadReport{Time: time.Now()}
+	defer func() {
+		this.mu.Lock()
+		this.lastReload = report
+		this.mu.Unlock()
+		this.publish()
+	}()
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Printf("reload: rejected: %v\r\n", err)
+		report.Error = err.Error()
+		return
+	}
+	old := this.config()
+	report.Applied, report.Restart = cfg.Diff(old)
+	// settings that need a restart keep their old values until then
+	cfg.PidFile, cfg.StateFile, cfg.ControlSocket = old.PidFile, old.StateFile, old.ControlSocket
+	cfg.User, cfg.Group, cfg.KeepNetBind = old.User, old.Group, old.KeepNetBind
+	cfg.Seccomp, cfg.SeccompAction, cfg.SeccompNotify, cfg.Landlock = old.Seccomp, old.SeccompAction, old.SeccompNotify, old.Landlock
+	cfg.Process, cfg.Exec = old.Process, old.Exec
+	if this.activated && cfg.Listen != old.Listen {
+		// systemd owns the sockets, the .socket unit has to change
+		report.Applied = without(report.Applied, "daemon.listen")
+		report.Restart = append(report.Restart, "daemon.listen")
+		cfg.Listen = old.Listen
+	}
+
+	var listener net.Listener
+	var logf *os.File
+	reject := func(err error) {
+		if listener != nil {
+			listener.Close()
+		}
+		if logf != nil {
+			logf.Close()
+		}
+		log.Printf("reload: rejected: %v\r\n", err)
+		report.Error = err.Error()
+		report.Applied, report.Restart = nil, nil
+	}
+	if this.handler != nil && cfg.Listen != old.Listen {
+		if listener, err = net.Listen("tcp", cfg.Listen); err != nil {
+			reject(err)
+			return
+		}
+	}
+	if this.reopenLog {
+		if logf, err = openLogFile(cfg.LogFile()); err != nil {
+			reject(err)
+			return
+		}
+	}
+	if err := this.program.Reload(cfg); err != nil {
+		reject(err)
+		return
+	}
+
+	this.mu.Lock()
+	this.cfg = cfg
+	this.mu.Unlock()
+	if logf != nil {
+		swapLogFile(logf)
+	}
+	if cfg.LogLevel != old.LogLevel {
+		// one set through the control socket lasts until the file changes
+		servicelib.SetLogLevel(cfg.LogLevel)
+	}
+	if listener != nil {
+		this.swapListeners([]net.Listener{listener})
+	}
+	log.Printf("reload: applied %v, restart needed for %v\r\n", report.Applied, report.Restart)
+}
+
+func without(keys []string, key string) []string {
+	var kept []string
+	for _, k := range keys {
+		if k != key {
+			kept = append(kept, k)
+		}
+	}
+	return kept
+}
+
+func (this *server) isPaused() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.paused
+}
+
+func (this *server) isClosing() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.closing
+}
+
+// waitRunning blocks while the server is paused.
+func (this *server) waitRunning() {
+	this.mu.Lock()
+	resume := this.resume
+	this.mu.Unlock()
+	if resume != nil {
+		<-resume
+	}
+}
+
+// pause pauses the program, then stops the accept loop and tells
+// connected clients about it.
+func (this *server) pause() error {
+	if this.isPaused() {
+		return nil
+	}
+	if err := this.program.Pause(); err != nil {
+		return fmt.Errorf("could not pause: %v", err)
+	}
+	this.mu.Lock()
+	this.paused = true
+	this.resume = make(chan struct{})
+	this.mu.Unlock()
+
+	// wake acceptConnection out of a blocking Accept
+	for _, listener := range this.currentListeners() {
+		if l, ok := listener.(interface {
+			SetDeadline(time.Time) error
+		}); ok {
+			l.SetDeadline(time.Now())
+		}
+	}
+	this.publish()
+	this.broadcast("service paused\r\n")
+	return nil
+}
+
+// shutdown stops accepting and gives the program until timeout to stop.
+// Then it tells connected clients the server is going away and gives
+// their handlers what is left of timeout to finish. Connections still
+// open after that are closed under their handlers.
+func (this *server) shutdown(listen <-chan net.Conn, timeout time.Duration) (drained, killed int) {
+	this.mu.Lock()
+	this.closing = true
+	if this.resume != nil {
+		// let a paused acceptConnection see the closed listener
+		close(this.resume)
+		this.resume = nil
+	}
+	listeners := this.listeners
+	this.mu.Unlock()
+	for _, listener := range listeners {
+		listener.Close()
+	}
+
+	// connections accepted but never handed to a handler
+loop:
+	for {
+		select {
+		case conn := <-listen:
+			conn.Close()
+		default:
+			break loop
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := this.program.Stop(ctx); err != nil {
+		log.Printf("shutdown: %v\r\n", err)
+	}
+	this.cancel()
+
+	this.broadcast("service shutting down\r\n")
+	clients := this.clientList()
+	for _, client := range clients {
+		// idle handlers wake up now, busy ones once they finish
+		client.SetReadDeadline(time.Now())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		this.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return len(clients), 0
+	case <-ctx.Done():
+	}
+
+	for _, client := range this.clientList() {
+		client.Close()
+		killed++
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		log.Print("shutdown: handlers still running after close\r\n")
+	}
+	return len(clients) - killed, killed
+}
+
+// cont has the program and the accept loop continue and tells connected
+// clients about it.
+func (this *server) cont() error {
+	if !this.isPaused() {
+		return nil
+	}
+	if err := this.program.Continue(); err != nil {
+		return fmt.Errorf("could not continue: %v", err)
+	}
+	this.mu.Lock()
+	this.paused = false
+	close(this.resume)
+	this.resume = nil
+	this.mu.Unlock()
+
+	this.publish()
+	this.broadcast("service resumed\r\n")
+	return nil
+}
+
+// broadcast writes msg to every connected client. A client that does
+// not read gets a second before it is skipped.
+func (this *server) broadcast(msg string) {
+	for _, client := range this.clientList() {
+		client.SetWriteDeadline(time.Now().Add(time.Second))
+		client.Write([]byte(msg))
+		client.SetWriteDeadline(time.Time{})
+	}
+}
+
+func (this *server) clientList() []net.Conn {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	clients := make([]net.Conn, 0, len(this.clients))
+	for client := range this.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// admit reports whether another client may connect under
+// daemon.max_connections, and logs when the limit is reached and when
+// clients fit again.
+func (this *server) admit() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	max := this.cfg.MaxConnections
+	full := max > 0 && len(this.clients) >= max
+	if full != this.full {
+		this.full = full
+		if full {
+			log.Printf("admit: %d connections, turning new clients away until some leave\r\n", max)
+		} else {
+			log.Print("admit: accepting new clients again\r\n")
+		}
+	}
+	return !full
+}
+
+// serve hands client to a new handler goroutine.
+func (this *server) serve(client net.Conn) {
+	this.mu.Lock()
+	this.clients[client] = time.Now()
+	this.mu.Unlock()
+	this.handlers.Add(1)
+	go handleClient(this, client)
+	this.notifyStatus()
+}
+
+func (this *server) removeClient(client net.Conn) {
+	this.mu.Lock()
+	delete(this.clients, client)
+	this.mu.Unlock()
+	this.notifyStatus()
+}
+
+// swapListeners moves the accept loops over to listeners and closes the
+// old ones. Connections accepted on the old listeners stay open.
+func (this *server) swapListeners(listeners []net.Listener) {
+	this.mu.Lock()
+	old := this.listeners
+	this.listeners = listeners
+	this.mu.Unlock()
+
+	for _, listener := range listeners {
+		go acceptConnection(this, listener, this.listen)
+	}
+	for _, listener := range old {
+		listener.Close()
+	}
+	this.publish()
+}
+
+func acceptConnection(srv *server, listener net.Listener, listen chan<- net.Conn) {
+	var delay time.Duration
+	for {
+		srv.waitRunning()
 		conn, err := listener.Accept()
 		if err != nil {
+			if srv.isClosing() || !srv.isCurrent(listener) {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// interrupted by pause, clear the deadline before accepting again
+				if l, ok := listener.(interface {
+					SetDeadline(time.Time) error
+				}); ok {
+					l.SetDeadline(time.Time{})
+				}
+				continue
+			}
+			// e.g. out of file descriptors, back off instead of spinning
+			srv.acceptFailed()
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			log.Printf("acceptConnection: %v, retrying in %v\r\n", err, delay)
+			time.Sleep(delay)
 			continue
 		}
+		delay = 0
 		listen <- conn
 	}
 }
 
-func handleClient(client net.Conn) {
+// handleClient has the program serve client.
+func handleClient(srv *server, client net.Conn) {
+	defer srv.handlers.Done()
+	defer srv.removeClient(client)
+	defer client.Close()
+	srv.handler.ServeConn(srv.ctx, client)
+}
+
+// relay passes signals on to the daemon in the pid file for as long as
+// one holds it, across upgrades, so a supervisor sees the daemon stop
+// when we do.
+func relay(pidfile string, signals ...chan os.Signal) {
+	merged := make(chan os.Signal, 1)
+	for _, ch := range signals {
+		go func(ch chan os.Signal) {
+			for sig := range ch {
+				merged <- sig
+			}
+		}(ch)
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
-		buf := make([]byte, 4096)
-		numbytes, err := client.Read(buf)
-		fmt.Printf("numbytes: %d, err: %s, buf: %v \r\n", numbytes, err, buf[:numbytes])
-		if numbytes == 0 || err != nil {
-			// EOF, close connection
+		pid, locked, err := servicelib.ReadPidFile(pidfile)
+		if err != nil || !locked || pid == os.Getpid() {
 			return
 		}
-		if numbytes == 2 && buf[0] == 13 && buf[1] == 10 {
-			// [13 10]  "\r\n"
-		} else {
-			now := time.Now()
-			str := fmt.Sprintf("%s: %s\r\n", now.Local().Format("15:04:05.999999999"), buf)
-			client.Write([]byte(str))
+		select {
+		case sig := <-merged:
+			log.Printf("relay: passing %v on to pid %d\r\n", sig, pid)
+			syscall.Kill(pid, sig.(syscall.Signal))
+		case <-ticker.C:
 		}
 	}
 }
 
-func runService(name string, idDebug bool) (string, error) {
-	log.Println("runService()\r\n")
+// runService runs program as the daemon until it is told to stop.
+func runService(name string, program servicelib.Program, isDebug bool) (string, error) {
+	log.Print("runService()\r\n")
 
 	// Set up channel on which to send signal notifications.
 	// We must use a buffered channel or risk missing the signal
@@ -57,27 +731,233 @@ func runService(name string, idDebug bool) (string, error) {
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt, os.Kill, syscall.SIGTERM)
 
-	// Set up listener for defined host and port
-	listener, err := net.Listen("tcp", port)
+	control := make(chan os.Signal, 1)
+	signal.Notify(control, servicelib.PauseSignal, servicelib.ContinueSignal, servicelib.ReloadSignal,
+		servicelib.UpgradeSignal)
+
+	cfg := config.Current()
+	if err := cfg.Validate(); err != nil {
+		return "Invalid configuration", err
+	}
+	servicelib.SetLogLevel(cfg.LogLevel)
+
+	// limits and the like go first, for everything we open to get them
+	process := &servicelib.ProcessSettings{
+		Limits:           cfg.Process.Limits,
+		Umask:            cfg.Process.Umask,
+		WorkingDirectory: cfg.Process.WorkingDirectory,
+		OOMScoreAdj:      cfg.Process.OOMScoreAdj,
+		Nice:             cfg.Process.Nice,
+	}
+	if err := process.Apply(); err != nil {
+		return "Could not set up the process", err
+	}
+	// every client holds a socket
+	if limit, ok := servicelib.OpenFilesLimit(); ok && cfg.MaxConnections > 0 && limit < uint64(cfg.MaxConnections) {
+		log.Printf("runService: open files limit %d is below daemon.max_connections %d, raise process.nofile\r\n",
+			limit, cfg.MaxConnections)
+	}
+
+	// Claim the pid file before anything else, so a second instance
+	// fails here instead of on the port binding
+	pidfile, err := servicelib.CreatePidFile(cfg.PidFile)
+	if err != nil {
+		return "Daemon is already running", err
+	}
+	defer pidfile.Remove()
+
+	// Set up listener for defined host and port, or take over the ones
+	// handed down by the process we upgrade from or by systemd; only a
+	// program that serves clients gets one
+	var listeners []net.Listener
+	var activated bool
+	if _, serves := program.(servicelib.ConnHandler); serves {
+		listeners, activated, err = servicelib.Listeners("tcp", cfg.Listen)
+		if err != nil {
+			return "Possibly was a problem with the port binding", err
+		}
+	}
+
+	// handedOver leaves the rest to the copy of us in pid
+	handedOver := func(pid int) {
+		servicelib.NotifyParent(nil)
+		if isDebug {
+			// whoever runs us in the foreground watches us, not pid;
+			// let go of the pid file lock, so we see when it does
+			pidfile.Remove()
+			relay(cfg.PidFile, interrupt, control)
+		}
+	}
+
+	sandbox := &servicelib.Sandbox{
+		Seccomp:  cfg.Seccomp,
+		Action:   cfg.SeccompAction,
+		Notify:   cfg.SeccompNotify,
+		Landlock: cfg.Landlock,
+		Write:    cfg.WriteDirs(),
+	}
+	if cfg.File != "" {
+		// editors replace the file, allow what takes its place too
+		sandbox.Read = []string{filepath.Dir(cfg.File)}
+	}
+
+	// the control socket is bound last, by the copy of us that serves;
+	// its directory has to be there before the switch and the sandbox
+	if cfg.ControlSocket != "" {
+		if err := os.MkdirAll(filepath.Dir(cfg.ControlSocket), 0755); err != nil {
+			return "Could not open the control socket", err
+		}
+	}
+
+	// The port is bound and the log file open; the rest runs as
+	// daemon.user in a copy of us, which gets the directories of its
+	// own that it writes to
+	if cfg.User != "" {
+		owned := []string{getLogFilePath()}
+		for _, path := range []string{cfg.PidFile, cfg.StateFile, cfg.ControlSocket} {
+			if dir := filepath.Dir(path); path != "" && filepath.Base(dir) == config.APPNAME {
+				owned = append(owned, dir)
+			}
+		}
+		pid, err := servicelib.DropPrivileges(cfg.User, cfg.Group, cfg.KeepNetBind, sandbox, listeners, pidfile,
+			cfg.UpgradeTimeout, owned...)
+		if err != nil {
+			return "Could not drop privileges", err
+		}
+		if pid != 0 {
+			handedOver(pid)
+			return fmt.Sprintf("Daemon carries on as %s in pid %d", cfg.User, pid), nil
+		}
+	}
+
+	// and is left to read its config and write its log and state
+	pid, err := sandbox.Apply(listeners, pidfile, cfg.UpgradeTimeout)
 	if err != nil {
-		return "Possibly was a problem with the port binding", err
+		return "Could not sandbox the daemon", err
+	}
+	if pid != 0 {
+		handedOver(pid)
+		return fmt.Sprintf("Daemon carries on sandboxed in pid %d", pid), nil
 	}
 
 	// set up channel on which to send accepted connections
-	listen := make(chan net.Conn, 100)
-	go acceptConnection(listener, listen)
+	srv := newServer(program, listeners, cfg)
+	defer srv.cancel()
+	srv.reopenLog = !isDebug
+	srv.activated = activated
+	defer close(srv.stopped)
+	if cfg.ControlSocket != "" {
+		if err := srv.listenControl(cfg.ControlSocket); err != nil {
+			return "Could not open the control socket", err
+		}
+		defer srv.closeControl()
+	}
+	if err := program.Start(srv.ctx); err != nil {
+		return "Could not start the program", err
+	}
+	srv.publish()
+	listen := srv.listen
+	for _, listener := range listeners {
+		go acceptConnection(srv, listener, listen)
+	}
+	servicelib.NotifyParent(nil)
+	notify("READY=1")
+
+	// keep the systemd watchdog happy for as long as we accept
+	var watchdog <-chan time.Time
+	if interval := servicelib.WatchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+
+	// result of an upgrade in progress, nil while there is none
+	var upgraded chan error
+
+	// a program that gives up takes the daemon down with it
+	var failed <-chan error
+	if failing, ok := program.(servicelib.Failing); ok {
+		failed = failing.Failed()
+	}
 
 	// loop work cycle with accept connections or interrupt
 	// by system signal
-	log.Println("Manage() loop\r\n")
+	log.Print("Manage() loop\r\n")
 	for {
 		select {
 		case conn := <-listen:
-			go handleClient(conn)
+			if srv.isPaused() {
+				// accepted just before the pause took effect
+				conn.Write([]byte("service paused\r\n"))
+				conn.Close()
+				continue
+			}
+			if !srv.admit() {
+				conn.Write([]byte("too many connections\r\n"))
+				conn.Close()
+				continue
+			}
+			srv.serve(conn)
+		case call := <-srv.calls:
+			call()
+		case sig := <-control:
+			log.Printf("Got signal: %v\r\n", sig)
+			switch sig {
+			case servicelib.PauseSignal:
+				if err := srv.pause(); err != nil {
+					log.Printf("runService: %v\r\n", err)
+				}
+			case servicelib.ContinueSignal:
+				if err := srv.cont(); err != nil {
+					log.Printf("runService: %v\r\n", err)
+				}
+			case servicelib.ReloadSignal:
+				srv.reload()
+			case servicelib.UpgradeSignal:
+				if upgraded != nil {
+					log.Print("runService: upgrade already in progress\r\n")
+					continue
+				}
+				upgraded = make(chan error, 1)
+				go func(result chan<- error) {
+					pid, err := servicelib.Upgrade(srv.currentListeners(), pidfile, srv.config().UpgradeTimeout)
+					if err == nil {
+						log.Printf("runService: pid %d is ready to take over\r\n", pid)
+					}
+					result <- err
+				}(upgraded)
+			}
+		case <-watchdog:
+			if !srv.acceptHealthy() {
+				log.Print("runService: accept is failing, skipping watchdog keepalive\r\n")
+				continue
+			}
+			notify("WATCHDOG=1")
+		case err := <-upgraded:
+			upgraded = nil
+			if err != nil {
+				log.Printf("runService: upgrade failed, keep serving: %v\r\n", err)
+				srv.upgradeFailed(err)
+				continue
+			}
+			// the new process owns the listener, pid file and state file now
+			drained, killed := srv.shutdown(listen, srv.config().DrainTimeout)
+			log.Printf("runService: %d connections drained, %d killed\r\n", drained, killed)
+			return "Daemon was upgraded", nil
+		case err := <-failed:
+			log.Printf("runService: %v, stopping\r\n", err)
+			notify("STOPPING=1")
+			drained, killed := srv.shutdown(listen, srv.config().DrainTimeout)
+			log.Printf("runService: %d connections drained, %d killed\r\n", drained, killed)
+			srv.publishShutdown(drained, killed, err)
+			return "Daemon failed", err
 		case killSignal := <-interrupt:
-			log.Println("Got signal:", killSignal, "\r\n")
-			log.Println("Stoping listening on ", listener.Addr(), "\r\n")
-			listener.Close()
+			log.Printf("Got signal: %v\r\n", killSignal)
+			log.Printf("Stoping listening on %v\r\n", srv.addrs())
+			notify("STOPPING=1")
+			drained, killed := srv.shutdown(listen, srv.config().DrainTimeout)
+			log.Printf("runService: %d connections drained, %d killed\r\n", drained, killed)
+			srv.publishShutdown(drained, killed, nil)
 			if killSignal == os.Interrupt {
 				return "Daemon was interruped by system signal", nil
 			}
@@ -3,12 +3,16 @@
 package main
 
 import (
+	"code.google.com/p/winsvc/debug"
 	"code.google.com/p/winsvc/svc"
+	"context"
 	"fmt"
+	"github.com/oliveagle/ole_tryout_daemon/config"
+	"github.com/oliveagle/ole_tryout_daemon/servicelib"
 	"log"
 	"net"
 	"os"
-	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -29,51 +33,188 @@ func beep() {
 	beepFunc.Call(0xffffffff)
 }
 
-func acceptConnection(listener net.Listener, listen chan<- net.Conn) {
+// acceptConnection has handler serve the clients that connect to
+// listener, except while the service is paused, until it stops.
+func (this *myservice) acceptConnection(ctx context.Context, listener net.Listener, handler servicelib.ConnHandler) {
 	for {
+		this.waitRunning()
 		conn, err := listener.Accept()
 		if err != nil {
+			if this.isClosing() {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// interrupted by pause, clear the deadline before accepting again
+				setDeadline(listener, time.Time{})
+			}
 			continue
 		}
-		listen <- conn
+		this.mu.Lock()
+		this.clients[conn] = true
+		this.mu.Unlock()
+		this.handlers.Add(1)
+		go func() {
+			defer this.handlers.Done()
+			defer func() {
+				this.mu.Lock()
+				delete(this.clients, conn)
+				this.mu.Unlock()
+			}()
+			defer conn.Close()
+			handler.ServeConn(ctx, conn)
+		}()
 	}
 }
 
-func handleClient(client net.Conn) {
-	for {
-		buf := make([]byte, 4096)
-		numbytes, err := client.Read(buf)
-		fmt.Printf("numbytes: %d, err: %s, buf: %v \r\n", numbytes, err, buf[:numbytes])
-		if numbytes == 0 || err != nil {
-			// EOF, close connection
-			return
-		}
-		if numbytes == 2 && buf[0] == 13 && buf[1] == 10 {
-			// [13 10]  "\r\n"
-		} else {
-			now := time.Now()
-			str := fmt.Sprintf("%s: %s\r\n", now.Local().Format("15:04:05.999999999"), buf)
-			client.Write([]byte(str))
-		}
+func setDeadline(listener net.Listener, t time.Time) {
+	if l, ok := listener.(interface {
+		SetDeadline(time.Time) error
+	}); ok {
+		l.SetDeadline(t)
+	}
+}
+
+// myservice drives program on behalf of the service control manager.
+type myservice struct {
+	program servicelib.Program
+
+	mu       sync.Mutex
+	listener net.Listener
+	clients  map[net.Conn]bool
+	handlers sync.WaitGroup
+	// resume is closed when a paused service continues
+	resume  chan struct{}
+	closing bool
+}
+
+// waitRunning blocks while the service is paused.
+func (this *myservice) waitRunning() {
+	this.mu.Lock()
+	resume := this.resume
+	this.mu.Unlock()
+	if resume != nil {
+		<-resume
 	}
 }
 
-type myservice struct{}
+func (this *myservice) isClosing() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.closing
+}
+
+// pause pauses the program, then wakes the accept loop out of Accept to
+// wait for continue.
+func (this *myservice) pause() error {
+	if err := this.program.Pause(); err != nil {
+		return err
+	}
+	this.mu.Lock()
+	if this.resume == nil {
+		this.resume = make(chan struct{})
+	}
+	listener := this.listener
+	this.mu.Unlock()
+	if listener != nil {
+		setDeadline(listener, time.Now())
+	}
+	return nil
+}
+
+func (this *myservice) cont() error {
+	if err := this.program.Continue(); err != nil {
+		return err
+	}
+	this.mu.Lock()
+	if this.resume != nil {
+		close(this.resume)
+		this.resume = nil
+	}
+	this.mu.Unlock()
+	return nil
+}
+
+// closeListener ends the accept loop, paused or not.
+func (this *myservice) closeListener() {
+	this.mu.Lock()
+	this.closing = true
+	if this.resume != nil {
+		close(this.resume)
+		this.resume = nil
+	}
+	listener := this.listener
+	this.mu.Unlock()
+	if listener != nil {
+		listener.Close()
+	}
+}
+
+// stop stops accepting and gives the program until timeout to stop, then
+// gives the clients' handlers what is left of it to finish, woken with a
+// read deadline. Connections still open after that are closed.
+func (this *myservice) stop(cancel context.CancelFunc, timeout time.Duration) {
+	this.closeListener()
+	ctx, stop := context.WithTimeout(context.Background(), timeout)
+	defer stop()
+	if err := this.program.Stop(ctx); err != nil {
+		log.Printf("myservice.Execute: %v\r\n", err)
+	}
+	cancel()
+
+	this.mu.Lock()
+	for client := range this.clients {
+		client.SetReadDeadline(time.Now())
+	}
+	this.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		this.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+	this.mu.Lock()
+	log.Printf("myservice.Execute: closing %d connections still open\r\n", len(this.clients))
+	for client := range this.clients {
+		client.Close()
+	}
+	this.mu.Unlock()
+}
 
 func (this *myservice) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (ssec bool, errno uint32) {
 	log.Println("myservice.Execute\r\n")
 	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPauseAndContinue
 	changes <- svc.Status{State: svc.StartPending}
 
+	cfg := config.Current()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	this.clients = map[net.Conn]bool{}
+	// only a program that serves clients gets a listener
+	if handler, ok := this.program.(servicelib.ConnHandler); ok {
+		listener, err := net.Listen("tcp", cfg.Listen)
+		if err != nil {
+			log.Printf("myservice.Execute: %v\r\n", err)
+			return true, 1
+		}
+		this.listener = listener
+		go this.acceptConnection(ctx, listener, handler)
+	}
+	if err := this.program.Start(ctx); err != nil {
+		log.Printf("myservice.Execute: could not start: %v\r\n", err)
+		this.closeListener()
+		return true, 2
+	}
+
 	fasttick := time.Tick(500 * time.Millisecond)
 	slowtick := time.Tick(2 * time.Second)
 	tick := fasttick
 
 	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
 
-	// execute Run
-	go serveConn(args, r, changes)
-
 	// major loop for signal processing.
 loop:
 	for {
@@ -90,72 +231,81 @@ loop:
 			case svc.Stop, svc.Shutdown:
 				break loop
 			case svc.Pause:
+				if err := this.pause(); err != nil {
+					log.Printf("myservice.Execute: %v\r\n", err)
+					continue
+				}
 				changes <- svc.Status{State: svc.Paused, Accepts: cmdsAccepted}
 				tick = slowtick
 			case svc.Continue:
+				if err := this.cont(); err != nil {
+					log.Printf("myservice.Execute: %v\r\n", err)
+					continue
+				}
 				changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
 				tick = fasttick
+			case servicelib.ReloadCmd:
+				cfg = this.reload(cfg)
 			default:
 				log.Printf("unexpected control request #%d", c)
 			}
 		}
 	}
 	changes <- svc.Status{State: svc.StopPending}
+	this.stop(cancel, cfg.DrainTimeout)
 	return
 }
 
-func runService(name string, isDebug bool) {
-	f, err := os.OpenFile(getLogFilePath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+// reload re-reads the config file and has the program take it on, and
+// returns the config the service runs with then: old when either fails.
+// The listener stays, a new daemon.listen needs a restart.
+func (this *myservice) reload(old *config.Config) *config.Config {
+	cfg, err := config.Load()
 	if err != nil {
-		fmt.Printf("error opening file: %v \n", err)
+		log.Printf("reload: rejected: %v\r\n", err)
+		return old
 	}
-	defer f.Close()
-	log.SetOutput(f)
-
-	log.Printf("runService: starting %s service \r\n", name)
-	err = svc.Run(name, &myservice{})
-	if err != nil {
-		log.Printf("runService: Error: %s service failed: %v\r\n", name, err)
-		return
+	applied, restart := cfg.Diff(old)
+	if cfg.Listen != old.Listen {
+		var kept []string
+		for _, key := range applied {
+			if key != "daemon.listen" {
+				kept = append(kept, key)
+			}
+		}
+		applied, restart = kept, append(restart, "daemon.listen")
+		cfg.Listen = old.Listen
 	}
-	log.Printf("runService: %s service stopped\r\n", name)
+	cfg.Exec = old.Exec
+	if err := this.program.Reload(cfg); err != nil {
+		log.Printf("reload: rejected: %v\r\n", err)
+		return old
+	}
+	log.Printf("reload: applied %v, restart needed for %v\r\n", applied, restart)
+	return cfg
 }
 
-func serveConn(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, error) {
-	log.Println("serveConn\r\n")
-
-	// Set up channel on which to send signal notifications.
-	// We must use a buffered channel or risk missing the signal
-	// if we're not ready to receive when the signal is sent.
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt, os.Kill, syscall.SIGTERM)
-
-	// Set up listener for defined host and port
-	listener, err := net.Listen("tcp", port)
-	if err != nil {
-		return false, err
+// runService runs program as a windows service until it is told to stop.
+func runService(name string, program servicelib.Program, isDebug bool) (string, error) {
+	run := svc.Run
+	if isDebug {
+		// stay on the console, main already logs to stderr
+		run = debug.Run
+	} else {
+		f, err := os.OpenFile(getLogFilePath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			fmt.Printf("error opening file: %v \n", err)
+		}
+		defer f.Close()
+		log.SetOutput(f)
 	}
 
-	// set up channel on which to send accepted connections
-	listen := make(chan net.Conn, 100)
-	go acceptConnection(listener, listen)
-
-	// loop work cycle with accept connections or interrupt
-	// by system signal
-	log.Println("Manage() loop\r\n")
-	for {
-		select {
-		case conn := <-listen:
-			go handleClient(conn)
-		case killSignal := <-interrupt:
-			log.Println("Got signal:", killSignal, "\r\n")
-			log.Println("Stoping listening on ", listener.Addr(), "\r\n")
-			listener.Close()
-			if killSignal == os.Interrupt {
-				return false, fmt.Errorf("Daemon was interruped by system signal")
-			}
-			return false, fmt.Errorf("Daemon was killed")
-		}
+	log.Printf("runService: starting %s service \r\n", name)
+	err := run(name, &myservice{program: program})
+	if err != nil {
+		log.Printf("runService: Error: %s service failed: %v\r\n", name, err)
+		return "Service failed", err
 	}
-	return true, nil
+	log.Printf("runService: %s service stopped\r\n", name)
+	return "Service stopped", nil
 }
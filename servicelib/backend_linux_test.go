@@ -0,0 +1,261 @@
+package servicelib
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// recorder stands in for Host.Run and keeps the command lines it got.
+type recorder struct {
+	calls [][]string
+}
+
+func (this *recorder) run(name string, args ...string) ([]byte, error) {
+	this.calls = append(this.calls, append([]string{name}, args...))
+	return nil, nil
+}
+
+// fakeHost returns a Host for oleservice below a temporary root holding
+// the paths in seed: a directory when it ends in a slash, else an
+// executable file.
+func fakeHost(t *testing.T, seed ...string) (*Host, *recorder) {
+	root := t.TempDir()
+	for _, path := range seed {
+		full := filepath.Join(root, path)
+		if strings.HasSuffix(path, "/") {
+			if err := os.MkdirAll(full, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec := &recorder{}
+	host := &Host{
+		Root: root,
+		Name: "oleservice",
+		Desc: "ole service description",
+		Exe:  "/usr/local/bin/oleservice",
+		Run:  rec.run,
+	}
+	return host, rec
+}
+
+// testConfig sets the settings the backends read from the config, and
+// resets them once the test is done.
+func testConfig(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.Set("daemon.pidfile", "/var/run/oleservice/oleservice.pid")
+	viper.Set("daemon.listen", ":9977")
+	viper.Set("daemon.drain_timeout", "10s")
+	viper.Set("log.logpath", "/var/log/oleservice")
+	viper.Set("service.user", "oleservice")
+	viper.Set("service.group", "oleservice")
+	viper.Set("service.restart", "on-failure")
+	viper.Set("service.restart_sec", "5s")
+	viper.Set("service.working_directory", "/")
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		seed []string
+		want string
+	}{
+		{[]string{"/run/systemd/system/"}, "systemd"},
+		{[]string{"/run/systemd/system/", "/etc/init.d/", "/usr/sbin/update-rc.d"}, "systemd"},
+		{[]string{"/run/openrc/"}, "openrc"},
+		{[]string{"/sbin/openrc-run", "/etc/init.d/", "/etc/inittab"}, "openrc"},
+		{[]string{"/run/runit/"}, "runit"},
+		{[]string{"/etc/runit/runsvdir/"}, "runit"},
+		{[]string{"/run/s6/"}, "s6"},
+		{[]string{"/usr/bin/s6-svscan"}, "s6"},
+		{[]string{"/etc/init.d/", "/usr/sbin/update-rc.d"}, "sysv"},
+		{[]string{"/etc/init.d/", "/sbin/chkconfig"}, "sysv"},
+		{[]string{"/etc/init.d/", "/etc/inittab"}, "sysv"},
+		{[]string{"/etc/init.d/"}, "nohup"},
+		{nil, "nohup"},
+	}
+	for _, test := range tests {
+		host, _ := fakeHost(t, test.seed...)
+		backend, err := SelectBackend(host, "")
+		if err != nil {
+			t.Errorf("%v: %v", test.seed, err)
+			continue
+		}
+		if backend.Name() != test.want {
+			t.Errorf("%v: detected %s, want %s", test.seed, backend.Name(), test.want)
+		}
+	}
+}
+
+func TestSelectBackendByName(t *testing.T) {
+	// an empty root looks like no init system at all
+	host, _ := fakeHost(t)
+	for _, name := range []string{"systemd", "systemd-user", "openrc", "runit", "s6", "sysv", "nohup"} {
+		backend, err := SelectBackend(host, name)
+		if err != nil {
+			t.Errorf("--backend=%s: %v", name, err)
+			continue
+		}
+		if backend.Name() != name {
+			t.Errorf("--backend=%s selected %s", name, backend.Name())
+		}
+	}
+	if _, err := SelectBackend(host, "upstart"); err == nil || !strings.Contains(err.Error(), `unknown backend "upstart"`) {
+		t.Errorf("--backend=upstart: got %v, want an unknown backend error", err)
+	}
+}
+
+// wantFile is an installed file by its path on the real system.
+type wantFile struct {
+	path string
+	mode os.FileMode
+}
+
+func TestBackendInstall(t *testing.T) {
+	tests := []struct {
+		backend string
+		seed    []string
+		files   []wantFile
+		cmds    Commands
+	}{
+		{
+			backend: "systemd",
+			files:   []wantFile{{"/etc/systemd/system/oleservice.service", 0644}},
+			cmds: Commands{
+				Install: [][]string{{"systemctl", "daemon-reload"}, {"systemctl", "enable", "oleservice.service"}},
+				Remove:  [][]string{{"systemctl", "stop", "oleservice.service"}, {"systemctl", "disable", "oleservice.service"}},
+				Cleanup: [][]string{{"systemctl", "daemon-reload"}},
+			},
+		},
+		{
+			backend: "openrc",
+			files:   []wantFile{{"/etc/init.d/oleservice", 0755}},
+			cmds: Commands{
+				Install: [][]string{{"rc-update", "add", "oleservice", "default"}},
+				Remove:  [][]string{{"rc-service", "oleservice", "stop"}, {"rc-update", "del", "oleservice", "default"}},
+			},
+		},
+		{
+			backend: "runit",
+			seed:    []string{"/etc/service/", "/usr/bin/sv"},
+			files: []wantFile{
+				{"/etc/sv/oleservice", os.ModeDir | 0755},
+				{"/etc/sv/oleservice/run", 0755},
+				{"/etc/sv/oleservice/finish", 0755},
+				{"/etc/sv/oleservice/log", os.ModeDir | 0755},
+				{"/etc/sv/oleservice/log/run", 0755},
+				{"/etc/service/oleservice", os.ModeSymlink | 0777},
+			},
+			cmds: Commands{
+				Remove: [][]string{
+					{"/usr/bin/sv", "down", "/etc/sv/oleservice"},
+					{"rm", "-rf", "/etc/sv/oleservice/supervise", "/etc/sv/oleservice/log/supervise"},
+				},
+			},
+		},
+		{
+			backend: "s6",
+			seed:    []string{"/run/service/", "/command/s6-svc", "/command/s6-svscanctl"},
+			files: []wantFile{
+				{"/etc/s6/sv/oleservice", os.ModeDir | 0755},
+				{"/etc/s6/sv/oleservice/run", 0755},
+				{"/etc/s6/sv/oleservice/finish", 0755},
+				{"/etc/s6/sv/oleservice/log", os.ModeDir | 0755},
+				{"/etc/s6/sv/oleservice/log/run", 0755},
+				{"/run/service/oleservice", os.ModeSymlink | 0777},
+			},
+			cmds: Commands{
+				Install: [][]string{{"/command/s6-svscanctl", "-a", "/run/service"}},
+				Remove: [][]string{
+					{"/command/s6-svc", "-d", "/etc/s6/sv/oleservice"},
+					{"rm", "-rf", "/etc/s6/sv/oleservice/supervise", "/etc/s6/sv/oleservice/log/supervise"},
+				},
+				Cleanup: [][]string{{"/command/s6-svscanctl", "-a", "/run/service"}},
+			},
+		},
+		{
+			backend: "sysv",
+			seed:    []string{"/etc/init.d/", "/usr/sbin/update-rc.d"},
+			files:   []wantFile{{"/etc/init.d/oleservice", 0755}},
+			cmds: Commands{
+				Install: [][]string{{"/usr/sbin/update-rc.d", "oleservice", "defaults"}},
+				Remove:  [][]string{{"/etc/init.d/oleservice", "stop"}, {"/usr/sbin/update-rc.d", "-f", "oleservice", "remove"}},
+			},
+		},
+		{
+			backend: "sysv",
+			seed:    []string{"/etc/init.d/", "/sbin/chkconfig"},
+			files:   []wantFile{{"/etc/init.d/oleservice", 0755}},
+			cmds: Commands{
+				Install: [][]string{{"/sbin/chkconfig", "--add", "oleservice"}},
+				Remove:  [][]string{{"/etc/init.d/oleservice", "stop"}, {"/sbin/chkconfig", "--del", "oleservice"}},
+			},
+		},
+		{
+			backend: "nohup",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.backend, func(t *testing.T) {
+			testConfig(t)
+			host, rec := fakeHost(t, test.seed...)
+			backend, err := SelectBackend(host, test.backend)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			files, err := backend.Files()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []wantFile
+			for _, f := range files {
+				got = append(got, wantFile{f.Path, f.Mode})
+			}
+			if !reflect.DeepEqual(got, test.files) {
+				t.Errorf("Files() = %v, want %v", got, test.files)
+			}
+			if cmds := backend.Commands(); !reflect.DeepEqual(cmds, test.cmds) {
+				t.Errorf("Commands() = %v, want %v", cmds, test.cmds)
+			}
+
+			// installing puts them below the root and runs the commands
+			if err := host.writeFiles(files); err != nil {
+				t.Fatal(err)
+			}
+			if err := host.runCommands(test.cmds.Install, false); err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range test.files {
+				info, err := os.Lstat(host.Path(f.path))
+				if err != nil {
+					t.Errorf("not installed: %v", err)
+					continue
+				}
+				// a symlink's own permissions mean nothing
+				if info.Mode()&os.ModeType != f.mode&os.ModeType ||
+					f.mode&os.ModeSymlink == 0 && info.Mode().Perm() != f.mode.Perm() {
+					t.Errorf("%s has mode %v, want %v", f.path, info.Mode(), f.mode)
+				}
+			}
+			if !reflect.DeepEqual(rec.calls, test.cmds.Install) {
+				t.Errorf("ran %v, want %v", rec.calls, test.cmds.Install)
+			}
+			if test.files != nil && !backend.Installed() {
+				t.Errorf("not Installed() after installing")
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+// +build linux darwin
+
+package servicelib
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Host is the machine a backend manages. Paths are resolved below Root,
+// so a backend can be pointed at a fake root directory, and init system
+// tools are run through Run, which can be replaced as well.
+type Host struct {
+	Root string
+	Name string
+	Desc string
+	// Exe is the daemon binary the service definitions start.
+	Exe string
+	Run func(name string, args ...string) ([]byte, error)
+}
+
+// NewHost returns the Host for the running system.
+func NewHost(name, desc string) *Host {
+	exe, err := os.Executable()
+	if err != nil {
+		exe = os.Args[0]
+	}
+	return &Host{
+		Root: "/",
+		Name: name,
+		Desc: desc,
+		Exe:  exe,
+		Run: func(name string, args ...string) ([]byte, error) {
+			return exec.Command(name, args...).CombinedOutput()
+		},
+	}
+}
+
+// Path returns where path is below the root.
+func (this *Host) Path(path string) string {
+	return filepath.Join(this.Root, path)
+}
+
+func (this *Host) exists(path string) bool {
+	_, err := os.Lstat(this.Path(path))
+	return err == nil
+}
+
+// command runs an init system tool and fails with its output.
+func (this *Host) command(name string, args ...string) error {
+	out, err := this.Run(name, args...)
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err,
+			strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// hasCommand reports whether one of the given paths holds a tool.
+func (this *Host) hasCommand(paths ...string) (string, bool) {
+	for _, path := range paths {
+		if this.exists(path) {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// errNotInstalled is what starting a service that was never installed
+// fails with.
+func (this *Host) errNotInstalled(backend string) error {
+	return fmt.Errorf("%s is not installed for %s; install it first, or use --backend=nohup", this.Name, backend)
+}
+
+// errNotRunning is what stopping a service that was never installed
+// fails with, when there is no pid file either.
+func (this *Host) errNotRunning() error {
+	return fmt.Errorf("service %s is not running", this.Name)
+}
+
+// staged reports whether the root is not the real system's, but a
+// directory files are staged in.
+func (this *Host) staged() bool {
+	return this.Root != "/" && this.Root != ""
+}
+
+// checkPrivileges fails unless we may change the real system. A fake
+// root belongs to whoever set it up.
+func (this *Host) checkPrivileges(action string) error {
+	if this.staged() {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("you must have root user privileges to %s %s, or use %s --user", action, this.Name, action)
+	}
+	return nil
+}
+
+// writeFiles puts files in place below the root. A regular file is
+// written next to its path and renamed over it, so replacing a binary
+// that is running works.
+func (this *Host) writeFiles(files []InstallFile) error {
+	for _, f := range files {
+		path := this.Path(f.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		switch {
+		case f.Mode&os.ModeDir != 0:
+			if err := os.MkdirAll(path, f.Mode.Perm()); err != nil {
+				return err
+			}
+		case f.Mode&os.ModeSymlink != 0:
+			os.Remove(path)
+			if err := os.Symlink(f.Link, path); err != nil {
+				return err
+			}
+		default:
+			if f.NoReplace && this.exists(f.Path) {
+				continue
+			}
+			if err := writeFile(path, f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeFile(path string, f InstallFile) error {
+	data := f.Data
+	if f.Source != "" {
+		var err error
+		if data, err = ioutil.ReadFile(f.Source); err != nil {
+			return err
+		}
+	}
+	tmp := path + ".new"
+	if err := ioutil.WriteFile(tmp, data, f.Mode.Perm()); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of a file that was already there
+	if err := os.Chmod(tmp, f.Mode.Perm()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// runCommands runs init system commands, stopping at the first that
+// fails unless keepGoing is set.
+func (this *Host) runCommands(cmds [][]string, keepGoing bool) error {
+	for _, cmd := range cmds {
+		if err := this.command(cmd[0], cmd[1:]...); err != nil {
+			if !keepGoing {
+				return err
+			}
+			log.Printf("%v\r\n", err)
+		}
+	}
+	return nil
+}
+
+// SelectBackend returns the backend called name, or when name is empty
+// the first one whose init system manages the machine.
+func SelectBackend(host *Host, name string) (IServiceManager, error) {
+	all := backends(host)
+	var names []string
+	for _, backend := range all {
+		if name == "" && backend.Detect() {
+			return backend, nil
+		}
+		if backend.Name() == name {
+			return backend, nil
+		}
+		names = append(names, backend.Name())
+	}
+	if name == "" {
+		return nil, fmt.Errorf("no init system backend found")
+	}
+	return nil, fmt.Errorf("unknown backend %q, want one of %s", name, strings.Join(names, ", "))
+}
+
+// backend returns the init system backend the service is managed by.
+func (this *Service) backend() (IServiceManager, error) {
+	return SelectBackend(this.host(), this.Backend)
+}
+
+// host returns the Host for the system, or for the staging root.
+func (this *Service) host() *Host {
+	host := NewHost(this.name, this.desc)
+	if this.Root != "" {
+		host.Root = this.Root
+	}
+	return host
+}
+
+// PrintServiceUnit writes the files install would create to w, without
+// touching the system.
+func (this *Service) PrintServiceUnit(w io.Writer) error {
+	host := this.host()
+	backend, err := SelectBackend(host, this.Backend)
+	if err != nil {
+		return err
+	}
+	if backend.Name() != "systemd-user" {
+		host.Exe = binPath(host.Name)
+	}
+	files, err := backend.Files()
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		fmt.Fprintf(w, "# the %s backend installs no files\n", backend.Name())
+	}
+	for i, f := range files {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		switch {
+		case f.Mode&os.ModeDir != 0:
+			fmt.Fprintf(w, "# %s/\n", f.Path)
+		case f.Mode&os.ModeSymlink != 0:
+			fmt.Fprintf(w, "# %s -> %s\n", f.Path, f.Link)
+		default:
+			fmt.Fprintf(w, "# %s\n", f.Path)
+			w.Write(f.Data)
+		}
+	}
+	return nil
+}
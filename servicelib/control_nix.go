@@ -0,0 +1,311 @@
+// +build linux darwin
+
+package servicelib
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// Commands the daemon answers on its control socket.
+const (
+	ControlStatus      = "status"
+	ControlPause       = "pause"
+	ControlContinue    = "continue"
+	ControlReload      = "reload"
+	ControlDrain       = "drain"
+	ControlConnections = "connections"
+	ControlLogLevel    = "log-level"
+	ControlDump        = "dump"
+)
+
+// ControlSocketPath returns the daemon's control socket, taken from
+// daemon.control_socket in the config, or /run/<name>/control.sock when
+// that is not set at all; empty when the config turns it off.
+func ControlSocketPath(name string) string {
+	if !viper.IsSet("daemon.control_socket") {
+		return "/run/" + name + "/control.sock"
+	}
+	return viper.GetString("daemon.control_socket")
+}
+
+// ControlRequest is one line of JSON a client sends on the control
+// socket.
+type ControlRequest struct {
+	Command string `json:"command"`
+	// Level is the level log-level switches to, empty to only ask.
+	Level string `json:"level,omitempty"`
+	// Timeout is how long drain waits for connections to finish, like
+	// "30s"; empty for daemon.drain_timeout.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// ControlResponse is the line of JSON the daemon answers a request with.
+// Which fields are set depends on the command.
+type ControlResponse struct {
+	OK          bool          `json:"ok"`
+	Error       string        `json:"error,omitempty"`
+	State       *DaemonState  `json:"state,omitempty"`
+	Reload      *ReloadReport `json:"reload,omitempty"`
+	Drain       *DrainReport  `json:"drain,omitempty"`
+	Connections []Connection  `json:"connections,omitempty"`
+	LogLevel    string        `json:"log_level,omitempty"`
+	Dump        string        `json:"dump,omitempty"`
+}
+
+// ControlError answers a request the daemon could not carry out.
+func ControlError(err error) *ControlResponse {
+	return &ControlResponse{Error: err.Error()}
+}
+
+// DrainReport is the answer to drain: the daemon stopped accepting, how
+// many connections finished within the timeout and how many are open
+// still.
+type DrainReport struct {
+	Drained int `json:"drained"`
+	Open    int `json:"open"`
+}
+
+// Connection is a client the daemon serves.
+type Connection struct {
+	Remote string    `json:"remote"`
+	Local  string    `json:"local"`
+	Since  time.Time `json:"since"`
+}
+
+// ControlHandler answers a request on the control socket.
+type ControlHandler func(req *ControlRequest) *ControlResponse
+
+// ControlListener is the daemon's end of the control socket.
+type ControlListener struct {
+	path     string
+	listener *net.UnixListener
+	// info tells our socket file from that of a daemon we upgrade to
+	info os.FileInfo
+}
+
+// ListenControl binds the control socket at path, which only the
+// daemon's account and group may connect to. A socket left at path by
+// the daemon we upgrade from, or one that crashed, is replaced; the pid
+// file already makes sure no other daemon is running.
+func ListenControl(path string) (*ControlListener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// bind aside and move the socket in place once its mode is right,
+	// so no one can connect before
+	tmp := fmt.Sprintf("%s.%d", path, os.Getpid())
+	os.Remove(tmp)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// we remove the file ourselves, when it is still ours
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0660); err != nil {
+		listener.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		listener.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &ControlListener{path: path, listener: listener, info: info}, nil
+}
+
+// Path returns where the socket is.
+func (this *ControlListener) Path() string {
+	return this.path
+}
+
+// Owned reports whether the socket file is still ours. It is not once a
+// daemon we upgrade to has replaced it.
+func (this *ControlListener) Owned() bool {
+	info, err := os.Stat(this.path)
+	return err == nil && os.SameFile(info, this.info)
+}
+
+// Close stops listening and removes the socket file, unless it belongs
+// to another daemon by now.
+func (this *ControlListener) Close() error {
+	if this.Owned() {
+		os.Remove(this.path)
+	}
+	return this.listener.Close()
+}
+
+// Serve answers requests with handler until the listener is closed. A
+// client may send any number of requests, one per line, and gets an
+// answer on a line of its own for each.
+func (this *ControlListener) Serve(handler ControlHandler) {
+	for {
+		conn, err := this.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Printf("control: %v\r\n", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		go serveControl(conn, handler)
+	}
+}
+
+func serveControl(conn net.Conn, handler ControlHandler) {
+	defer conn.Close()
+	decoder := json.NewDecoder(bufio.NewReader(conn))
+	encoder := json.NewEncoder(conn)
+	for {
+		req := &ControlRequest{}
+		if err := decoder.Decode(req); err != nil {
+			if err != io.EOF {
+				encoder.Encode(ControlError(fmt.Errorf("bad request: %v", err)))
+			}
+			return
+		}
+		log.Printf("control: %s\r\n", req.Command)
+		resp := handler(req)
+		if resp.Error == "" {
+			resp.OK = true
+		}
+		if err := encoder.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+// errNoControl is what control returns when nothing answers on the
+// control socket: the daemon is not running, or has no control socket.
+var errNoControl = fmt.Errorf("no control socket")
+
+// control sends req to the daemon and returns its answer, giving it
+// timeout to carry it out.
+func (this *Service) control(req *ControlRequest, timeout time.Duration) (*ControlResponse, error) {
+	path := ControlSocketPath(this.name)
+	if path == "" {
+		return nil, errNoControl
+	}
+	conn, err := net.DialTimeout("unix", path, 2*time.Second)
+	if err != nil {
+		log.Printf("control: %v\r\n", err)
+		return nil, errNoControl
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	resp := &ControlResponse{}
+	if err := json.NewDecoder(conn).Decode(resp); err != nil {
+		return nil, fmt.Errorf("no answer from %s on %s: %v", this.name, path, err)
+	}
+	if !resp.OK {
+		return nil, fmt.Errorf("%s", resp.Error)
+	}
+	return resp, nil
+}
+
+// mustControl is control for the commands only the control socket
+// offers, with an error that says why the daemon does not answer.
+func (this *Service) mustControl(req *ControlRequest, timeout time.Duration) (*ControlResponse, error) {
+	resp, err := this.control(req, timeout)
+	if err != errNoControl {
+		return resp, err
+	}
+	if _, err := this.runningPid(); err != nil {
+		return nil, err
+	}
+	if path := ControlSocketPath(this.name); path != "" {
+		// e.g. permission denied, say so
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("%s does not answer on %s: %v", this.name, path, err)
+		}
+		conn.Close()
+		return nil, fmt.Errorf("%s does not answer on %s", this.name, path)
+	}
+	return nil, fmt.Errorf("%s has no control socket, see daemon.control_socket", this.name)
+}
+
+// DrainService has the daemon stop accepting and waits up to timeout,
+// or daemon.drain_timeout when 0, for the connections it serves to
+// finish. The daemon stays paused until it is continued.
+func (this *Service) DrainService(timeout time.Duration) error {
+	log.Print("ServiceManager.DrainService\r\n")
+	req := &ControlRequest{Command: ControlDrain}
+	wait := viper.GetDuration("daemon.drain_timeout")
+	if timeout > 0 {
+		req.Timeout = timeout.String()
+		wait = timeout
+	}
+	resp, err := this.mustControl(req, wait+10*time.Second)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s paused: %d connections drained, %d still open\n", this.name, resp.Drain.Drained, resp.Drain.Open)
+	return nil
+}
+
+// ListConnections writes the clients the daemon serves to w, one per
+// line, or as a JSON array.
+func (this *Service) ListConnections(w io.Writer, asJSON bool) error {
+	log.Print("ServiceManager.ListConnections\r\n")
+	resp, err := this.mustControl(&ControlRequest{Command: ControlConnections}, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		conns := resp.Connections
+		if conns == nil {
+			conns = []Connection{}
+		}
+		return json.NewEncoder(w).Encode(conns)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "REMOTE\tLOCAL\tCONNECTED")
+	for _, c := range resp.Connections {
+		fmt.Fprintf(tw, "%s\t%s\t%s ago\n", c.Remote, c.Local, time.Since(c.Since).Truncate(time.Second))
+	}
+	return tw.Flush()
+}
+
+// ChangeLogLevel switches the daemon's log to level until it restarts,
+// or reloads a config with another log.level. An empty level only shows
+// the current one.
+func (this *Service) ChangeLogLevel(level string) error {
+	log.Print("ServiceManager.ChangeLogLevel\r\n")
+	resp, err := this.mustControl(&ControlRequest{Command: ControlLogLevel, Level: level}, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s logs at level %s\n", this.name, resp.LogLevel)
+	return nil
+}
+
+// DumpGoroutines writes the stacks of all the daemon's goroutines to w.
+func (this *Service) DumpGoroutines(w io.Writer) error {
+	log.Print("ServiceManager.DumpGoroutines\r\n")
+	resp, err := this.mustControl(&ControlRequest{Command: ControlDump}, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, resp.Dump)
+	return err
+}
@@ -0,0 +1,26 @@
+// +build linux darwin
+
+package servicelib
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestControlSocketPath(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	if got, want := ControlSocketPath("oleservice"), "/run/oleservice/control.sock"; got != want {
+		t.Errorf("unset: %s, want %s", got, want)
+	}
+	viper.SetDefault("daemon.control_socket", "/run/user/1000/oleservice.control.sock")
+	if got, want := ControlSocketPath("oleservice"), "/run/user/1000/oleservice.control.sock"; got != want {
+		t.Errorf("default: %s, want %s", got, want)
+	}
+	// an empty setting turns the socket off
+	viper.Set("daemon.control_socket", "")
+	if got := ControlSocketPath("oleservice"); got != "" {
+		t.Errorf("turned off: %s, want none", got)
+	}
+}
@@ -0,0 +1,98 @@
+// +build linux darwin
+
+package servicelib
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// detachUmask is the umask a detached daemon starts with, whatever
+	// the shell that started it had.
+	detachUmask = 022
+	// configFileEnv names the config file a detached daemon reads; the
+	// config package looks for it.
+	configFileEnv = "OLESERVICE_CONFIG"
+)
+
+// detach runs the daemon in the background on its own, the way a daemon
+// forks itself away from the shell: a new session without a controlling
+// terminal, stdin on /dev/null, stdout and stderr appended to its log
+// file, umask 022 and service.working_directory as working directory.
+// The daemon writes its pid file itself; detach returns the pid from it
+// once the daemon reports through NotifyParent that it serves, or the
+// error it failed to start with.
+func (this *Host) detach() (int, error) {
+	path := PidFilePath(this.Name)
+	if pid, locked, err := ReadPidFile(path); err == nil && locked && processAlive(pid) {
+		return 0, fmt.Errorf("%s is already running as pid %d", this.Name, pid)
+	}
+
+	devnull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer devnull.Close()
+	// a panic or anything else the daemon writes before its log is set
+	// up goes to the log file too
+	out := devnull
+	if dir := viper.GetString("log.logpath"); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err == nil {
+			f, err := os.OpenFile(filepath.Join(dir, this.Name+".log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err == nil {
+				defer f.Close()
+				out = f
+			}
+		}
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(this.Exe, "run")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = devnull, out, out
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.Env = append(withoutHandoffEnv(os.Environ()), fmt.Sprintf("%s=%d", readyFdEnv, 3))
+	// the config was found relative to our working directory, not the
+	// daemon's
+	if used := viper.ConfigFileUsed(); used != "" {
+		if abs, err := filepath.Abs(used); err == nil {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", configFileEnv, abs))
+		}
+	}
+	cmd.Dir = viper.GetString("service.working_directory")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	// the child inherits the umask at fork, there is no other way to
+	// hand it one
+	old := syscall.Umask(detachUmask)
+	err = cmd.Start()
+	syscall.Umask(old)
+	w.Close()
+	if err != nil {
+		return 0, err
+	}
+	// the daemon outlives us, leave it to init once we exit
+	defer cmd.Process.Release()
+
+	timeout := viper.GetDuration("daemon.upgrade_timeout")
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	if err := WaitReady(r, timeout); err != nil {
+		return 0, fmt.Errorf("%s did not start: %v", this.Name, err)
+	}
+	// it may have handed over to a copy running as daemon.user
+	if pid, _, err := ReadPidFile(path); err == nil {
+		return pid, nil
+	}
+	return cmd.Process.Pid, nil
+}
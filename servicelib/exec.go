@@ -0,0 +1,231 @@
+package servicelib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/oliveagle/ole_tryout_daemon/config"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// childLineMax is the most of a line of the child's output logged as
+// one entry; a longer line is split.
+const childLineMax = 64 << 10
+
+// Exec is a Program that runs another program as the service, the way
+// NSSM and winsw do: it starts exec.command as its child and logs what
+// the child writes to stdout and stderr. That output has no file of its
+// own: it goes to the daemon's log, which reload reopens for logrotate
+// to rotate it. It passes stop and reload on to
+// the child as exec.stop_signal and exec.reload_signal, and pause and
+// continue as SIGSTOP and SIGCONT. A child that exits is restarted by
+// exec.restart under a Supervisor, so one that keeps crashing has the
+// daemon fail, and status shows how it last exited.
+type Exec struct {
+	*Supervisor
+
+	cfg  config.Exec
+	name string
+	attr *syscall.SysProcAttr
+
+	mu      sync.Mutex
+	process *os.Process
+	paused  bool
+	state   ChildState
+}
+
+// NewExec returns an Exec for the [exec] section cfg.
+func NewExec(cfg config.Exec) *Exec {
+	this := &Exec{cfg: cfg, name: filepath.Base(cfg.Command)}
+	this.state.Command = cfg.Command
+	this.Supervisor = NewSupervisor(&Component{
+		Name:     this.name,
+		Run:      this.run,
+		Pause:    this.pause,
+		Continue: this.cont,
+		Reload:   this.reload,
+	})
+	this.MinBackoff = cfg.RestartSec
+	this.MaxRestarts = cfg.MaxRestarts
+	this.RestartPeriod = cfg.RestartPeriod
+	return this
+}
+
+// Start starts the child, once it is sure there is one to start and
+// the account to start it as.
+func (this *Exec) Start(ctx context.Context) error {
+	if _, err := exec.LookPath(this.cfg.Command); err != nil {
+		return fmt.Errorf("exec.command: %v", err)
+	}
+	attr, err := childAttr(this.cfg.User, this.cfg.Group)
+	if err != nil {
+		return err
+	}
+	this.attr = attr
+	return this.Supervisor.Start(ctx)
+}
+
+// Stop gives the child until ctx expires to exit after the stop signal,
+// and kills it then.
+func (this *Exec) Stop(ctx context.Context) error {
+	err := this.Supervisor.Stop(ctx)
+	if err != nil {
+		this.signal(os.Kill)
+	}
+	return err
+}
+
+// Child returns the state of the child for status.
+func (this *Exec) Child() *ChildState {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	state := this.state
+	return &state
+}
+
+// run starts the child and waits for it to exit. It returns an error
+// for the supervisor to restart it, unless it exited with status 0 under
+// exec.restart = "on-failure".
+func (this *Exec) run(ctx context.Context) error {
+	cmd := exec.Command(this.cfg.Command, this.cfg.Args...)
+	cmd.Env = append(os.Environ(), this.cfg.Env...)
+	cmd.Dir = this.cfg.WorkingDirectory
+	cmd.SysProcAttr = this.attr
+	// pipes of our own instead of cmd's, so Wait does not wait for a
+	// grandchild that keeps them open
+	stdout, err := this.logPipe(this.name)
+	if err != nil {
+		return err
+	}
+	stderr, err := this.logPipe(this.name + " (stderr)")
+	if err != nil {
+		stdout.Close()
+		return err
+	}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	err = cmd.Start()
+	stdout.Close()
+	stderr.Close()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	this.mu.Lock()
+	this.process = cmd.Process
+	this.state.Pid = cmd.Process.Pid
+	this.state.Started = &now
+	paused := this.paused
+	this.mu.Unlock()
+	log.Printf("exec: started %s as pid %d\r\n", this.cfg.Command, cmd.Process.Pid)
+	if paused {
+		// restarted while the daemon is paused
+		this.signal(pauseSignal)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-ctx.Done():
+		if err := this.signal(signalByName(this.cfg.StopSignal)); err != nil {
+			// e.g. on windows, which has no signals to ask with
+			this.signal(os.Kill)
+		}
+		// continue a paused child, so it gets to handle the signal
+		this.signal(continueSignal)
+		<-exited
+	}
+
+	status := &ExitStatus{Time: time.Now(), Code: cmd.ProcessState.ExitCode(), Signal: exitSignal(cmd.ProcessState)}
+	this.mu.Lock()
+	this.process = nil
+	this.state.Pid = 0
+	this.state.Exit = status
+	this.mu.Unlock()
+	log.Printf("exec: pid %d %s\r\n", cmd.Process.Pid, status)
+
+	if ctx.Err() != nil || status.Code == 0 && this.cfg.Restart == "on-failure" {
+		return nil
+	}
+	if status.Signal != "" {
+		return fmt.Errorf("killed by signal %s", status.Signal)
+	}
+	return fmt.Errorf("exited with status %d", status.Code)
+}
+
+// logPipe returns a pipe for the child to write to, whose lines go to
+// the log after prefix until the child and all it started close it.
+func (this *Exec) logPipe(prefix string) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		defer r.Close()
+		lines := bufio.NewReaderSize(r, childLineMax)
+		for {
+			line, _, err := lines.ReadLine()
+			if line := strings.TrimRight(string(line), "\r"); line != "" {
+				log.Printf("%s: %s\r\n", prefix, line)
+			}
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("exec: reading %s: %v\r\n", prefix, err)
+				}
+				return
+			}
+		}
+	}()
+	return w, nil
+}
+
+// signal sends sig to the child and what it started, when it runs.
+func (this *Exec) signal(sig os.Signal) error {
+	return this.signalChild(sig, true)
+}
+
+func (this *Exec) signalChild(sig os.Signal, group bool) error {
+	this.mu.Lock()
+	process := this.process
+	this.mu.Unlock()
+	if process == nil {
+		return nil
+	}
+	return signalChild(process, sig, group)
+}
+
+func (this *Exec) pause() error {
+	this.mu.Lock()
+	this.paused = true
+	this.mu.Unlock()
+	return this.signal(pauseSignal)
+}
+
+func (this *Exec) cont() error {
+	this.mu.Lock()
+	this.paused = false
+	this.mu.Unlock()
+	return this.signal(continueSignal)
+}
+
+// reload passes exec.reload_signal on to the child alone, like systemd
+// does. The child keeps the [exec] settings it was started with, they
+// need a restart.
+func (this *Exec) reload(cfg *config.Config) error {
+	if this.cfg.ReloadSignal == "" {
+		return nil
+	}
+	return this.signalChild(signalByName(this.cfg.ReloadSignal), false)
+}
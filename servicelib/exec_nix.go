@@ -0,0 +1,76 @@
+// +build linux darwin
+
+package servicelib
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// What Exec passes pause and continue on to the child as.
+var (
+	pauseSignal    os.Signal = syscall.SIGSTOP
+	continueSignal os.Signal = syscall.SIGCONT
+)
+
+// signalByName returns the signal by one of config.SignalNames.
+func signalByName(name string) os.Signal {
+	return map[string]os.Signal{
+		"HUP":  syscall.SIGHUP,
+		"INT":  syscall.SIGINT,
+		"QUIT": syscall.SIGQUIT,
+		"TERM": syscall.SIGTERM,
+		"USR1": syscall.SIGUSR1,
+		"USR2": syscall.SIGUSR2,
+	}[name]
+}
+
+// childAttr starts the child in a process group of its own, as userName
+// in groupName when set. The group keeps a Ctrl-C in the terminal away
+// from the child, and lets signalChild reach what the child started.
+func childAttr(userName, groupName string) (*syscall.SysProcAttr, error) {
+	attr := &syscall.SysProcAttr{Setpgid: true}
+	if userName == "" {
+		return attr, nil
+	}
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("exec.user needs the daemon to run as root")
+	}
+	cred, err := lookupCredentials("exec", userName, groupName)
+	if err != nil {
+		return nil, err
+	}
+	attr.Credential = &syscall.Credential{
+		Uid: uint32(cred.uid),
+		Gid: uint32(cred.gid),
+		// clears the supplementary groups
+		Groups: []uint32{},
+	}
+	return attr, nil
+}
+
+// signalChild sends sig to the child, with group to its whole process
+// group.
+func signalChild(process *os.Process, sig os.Signal, group bool) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("cannot send %v", sig)
+	}
+	pid := process.Pid
+	if group {
+		pid = -pid
+	}
+	if err := syscall.Kill(pid, s); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+// exitSignal returns the signal that killed the child, if one did.
+func exitSignal(state *os.ProcessState) string {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return status.Signal().String()
+	}
+	return ""
+}
@@ -0,0 +1,58 @@
+package servicelib
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a log output the test can read while the log writes.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (this *lockedBuffer) Write(p []byte) (int, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.buf.Write(p)
+}
+
+func (this *lockedBuffer) String() string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.buf.String()
+}
+
+func TestLogPipe(t *testing.T) {
+	var out lockedBuffer
+	log.SetOutput(&out)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	})
+
+	w, err := (&Exec{}).logPipe("child")
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("x", childLineMax+10)
+	w.WriteString("first\r\n\nsecond\n" + long + "\nlast")
+	w.Close()
+
+	want := "child: first\r\nchild: second\r\n" +
+		"child: " + long[:childLineMax] + "\r\nchild: xxxxxxxxxx\r\n" +
+		"child: last\r\n"
+	deadline := time.Now().Add(5 * time.Second)
+	for out.String() != want && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := out.String(); got != want {
+		t.Errorf("logged %d bytes:\n%.200q\nwant %d bytes:\n%.200q", len(got), got, len(want), want)
+	}
+}
@@ -0,0 +1,38 @@
+// +build windows
+
+package servicelib
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// windows has no signals to pause and continue the child with.
+var (
+	pauseSignal    os.Signal
+	continueSignal os.Signal
+)
+
+func signalByName(name string) os.Signal {
+	return nil
+}
+
+func childAttr(userName, groupName string) (*syscall.SysProcAttr, error) {
+	if userName != "" {
+		return nil, fmt.Errorf("exec.user is not supported on windows")
+	}
+	return nil, nil
+}
+
+// signalChild can only kill the child.
+func signalChild(process *os.Process, sig os.Signal, group bool) error {
+	if sig == os.Kill {
+		return process.Kill()
+	}
+	return fmt.Errorf("exec: signals are not supported on windows")
+}
+
+func exitSignal(state *os.ProcessState) string {
+	return ""
+}
@@ -0,0 +1,212 @@
+// +build linux darwin
+
+package servicelib
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Environment variables a daemon uses to hand its resources to the
+// process that replaces it. Listeners are passed as fds 3 and up.
+const (
+	listenFdsEnv       = "OLESERVICE_LISTEN_FDS"
+	listenActivatedEnv = "OLESERVICE_LISTEN_ACTIVATED"
+	pidFileFdEnv       = "OLESERVICE_PIDFILE_FD"
+	readyFdEnv         = "OLESERVICE_READY_FD"
+	seccompFdEnv       = "OLESERVICE_SECCOMP_FD"
+)
+
+// seccompListener receives the system calls our seccomp filter does not
+// allow, nil without a filter. The filter stays with every process we
+// start, which cannot have a listener of its own then, so it gets ours.
+var seccompListener *os.File
+
+// Upgrade starts the daemon's binary again, which may have been replaced
+// on disk since we started, and hands it the listeners and the locked
+// pid file. It waits up to timeout for the new process to report ready
+// and returns its pid. On error the new process has been killed and the
+// pid file records our pid again, so the caller just keeps serving.
+func Upgrade(listeners []net.Listener, pidfile *PidFile, timeout time.Duration) (int, error) {
+	return handOver(listeners, pidfile, timeout, nil)
+}
+
+// handOver starts the daemon's binary as a new process with attr and the
+// extra environment variables in env, and hands it the listeners and pid
+// file, see Upgrade.
+func handOver(listeners []net.Listener, pidfile *PidFile, timeout time.Duration, attr *syscall.SysProcAttr, env ...string) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		filer, ok := l.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return 0, fmt.Errorf("cannot pass listener %s to a new process", l.Addr())
+		}
+		f, err := filer.File()
+		if err != nil {
+			return 0, err
+		}
+		files = append(files, f)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, pidfile.file, w)
+	cmd.Env = append(withoutHandoffEnv(os.Environ()),
+		fmt.Sprintf("%s=%d", listenFdsEnv, len(files)),
+		fmt.Sprintf("%s=%d", pidFileFdEnv, 3+len(files)),
+		fmt.Sprintf("%s=%d", readyFdEnv, 4+len(files)),
+	)
+	if socketActivated {
+		// the sockets still belong to systemd
+		cmd.Env = append(cmd.Env, listenActivatedEnv+"=1")
+	}
+	if seccompListener != nil {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, seccompListener)
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", seccompFdEnv, 5+len(files)))
+	}
+	cmd.Env = append(cmd.Env, env...)
+	cmd.SysProcAttr = attr
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := WaitReady(r, timeout); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if werr := writePid(pidfile.file, os.Getpid()); werr != nil {
+			return 0, fmt.Errorf("%v, and could not reclaim pid file: %v", err, werr)
+		}
+		return 0, err
+	}
+	if err := SdNotify(fmt.Sprintf("MAINPID=%d", cmd.Process.Pid)); err != nil {
+		log.Printf("Upgrade: could not tell systemd about pid %d: %v\r\n", cmd.Process.Pid, err)
+	}
+	return cmd.Process.Pid, nil
+}
+
+func withoutHandoffEnv(env []string) []string {
+	kept := env[:0:0]
+	for _, kv := range env {
+		if strings.HasPrefix(kv, listenFdsEnv+"=") ||
+			strings.HasPrefix(kv, listenActivatedEnv+"=") ||
+			strings.HasPrefix(kv, pidFileFdEnv+"=") ||
+			strings.HasPrefix(kv, readyFdEnv+"=") ||
+			strings.HasPrefix(kv, seccompFdEnv+"=") ||
+			// names us, the watchdog moves on to the new main pid
+			strings.HasPrefix(kv, "WATCHDOG_PID=") {
+			continue
+		}
+		kept = append(kept, kv)
+	}
+	return kept
+}
+
+// inheritedFd returns the fd named by the environment variable key, and
+// clears it so the fd is only ever taken once.
+func inheritedFd(key string) (int, bool) {
+	fd, err := strconv.Atoi(os.Getenv(key))
+	os.Unsetenv(key)
+	if err != nil || fd < 3 {
+		return 0, false
+	}
+	syscall.CloseOnExec(fd)
+	return fd, true
+}
+
+// inheritedListeners returns the listeners handed down by Upgrade, nil
+// when the process was started normally.
+func inheritedListeners() ([]net.Listener, error) {
+	n, err := strconv.Atoi(os.Getenv(listenFdsEnv))
+	os.Unsetenv(listenFdsEnv)
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	if os.Getenv(listenActivatedEnv) != "" {
+		socketActivated = true
+	}
+	os.Unsetenv(listenActivatedEnv)
+	return filesListeners(3, n, nil)
+}
+
+// inheritedPidFile takes over the pid file handed down by Upgrade. The
+// lock came along with the file descriptor.
+func inheritedPidFile(path string) (*PidFile, bool, error) {
+	fd, ok := inheritedFd(pidFileFdEnv)
+	if !ok {
+		return nil, false, nil
+	}
+	f := os.NewFile(uintptr(fd), path)
+	if !sameFile(f, path) {
+		f.Close()
+		return nil, true, fmt.Errorf("inherited pid file is not %s", path)
+	}
+	if err := writePid(f, os.Getpid()); err != nil {
+		f.Close()
+		return nil, true, err
+	}
+	return &PidFile{path: path, file: f, inherited: true}, true, nil
+}
+
+// NotifyParent tells a parent waiting in WaitReady how startup went: nil
+// for ready, or the error startup failed with. It does nothing when no
+// parent is waiting, and only reports once.
+func NotifyParent(startErr error) {
+	fd, ok := inheritedFd(readyFdEnv)
+	if !ok {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+	if startErr != nil {
+		fmt.Fprintf(f, "error %s\n", strings.Replace(startErr.Error(), "\n", " ", -1))
+		return
+	}
+	fmt.Fprintln(f, "ready")
+}
+
+// WaitReady waits up to timeout for the child holding the other end of r
+// to report through NotifyParent.
+func WaitReady(r *os.File, timeout time.Duration) error {
+	r.SetReadDeadline(time.Now().Add(timeout))
+	line, err := bufio.NewReader(r).ReadString('\n')
+	line = strings.TrimSpace(line)
+	switch {
+	case line == "ready":
+		return nil
+	case strings.HasPrefix(line, "error "):
+		return errors.New(strings.TrimPrefix(line, "error "))
+	case os.IsTimeout(err):
+		return fmt.Errorf("new process not ready after %v", timeout)
+	}
+	return fmt.Errorf("new process exited before becoming ready")
+}
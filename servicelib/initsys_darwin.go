@@ -0,0 +1,27 @@
+package servicelib
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// ioctlReadTermios is the ioctl isTerminal probes a file descriptor with.
+const ioctlReadTermios = syscall.TIOCGETA
+
+// backends lists the init systems we support on macOS, in the order
+// they are detected in.
+func backends(host *Host) []IServiceManager {
+	return []IServiceManager{
+		&launchdBackend{host},
+		&nohupBackend{host},
+	}
+}
+
+// accountCommands creates no accounts; on macOS that takes dscl and a
+// free uid, which we leave to the admin.
+func (this *Host) accountCommands(user, group, home string) (add, del [][]string) {
+	if _, ok := this.lookupAccount(user, false); !ok {
+		fmt.Printf("create the user %s for %s to run as\n", user, this.Name)
+	}
+	return nil, nil
+}
@@ -0,0 +1,74 @@
+package servicelib
+
+import (
+	"syscall"
+)
+
+// ioctlReadTermios is the ioctl isTerminal probes a file descriptor with.
+const ioctlReadTermios = syscall.TCGETS
+
+// backends lists the init systems we support on Linux, in the order
+// they are detected in. A user's own systemd units come first, nohup
+// always matches and comes last.
+func backends(host *Host) []IServiceManager {
+	return []IServiceManager{
+		&systemdBackend{host, true},
+		&systemdBackend{host, false},
+		&openrcBackend{host},
+		&superviseBackend{host, "runit"},
+		&superviseBackend{host, "s6"},
+		&sysvBackend{host},
+		&nohupBackend{host},
+	}
+}
+
+// accountCommands creates the system user and group the service runs
+// as, those that are missing, and deletes them again on purge. The
+// user's home is the service's state directory, which is how a later
+// install tells the account is ours to purge as well; a shared account
+// like nobody is left alone. BusyBox, e.g. on Alpine, only has adduser
+// and addgroup.
+func (this *Host) accountCommands(user, group, home string) (add, del [][]string) {
+	nologin, ok := this.hasCommand("/usr/sbin/nologin", "/sbin/nologin")
+	if !ok {
+		nologin = "/bin/false"
+	}
+	_, shadow := this.hasCommand("/usr/sbin/useradd", "/sbin/useradd")
+	_, busybox := this.hasCommand("/usr/sbin/adduser", "/sbin/adduser", "/bin/adduser")
+	busybox = busybox && !shadow
+
+	userHome, userExists := this.lookupAccount(user, false)
+	_, groupExists := this.lookupAccount(group, true)
+	ours := !userExists || userHome == home
+
+	if !groupExists {
+		if busybox {
+			add = append(add, []string{"addgroup", "-S", group})
+		} else {
+			add = append(add, []string{"groupadd", "--system", group})
+		}
+	}
+	if !userExists {
+		if busybox {
+			add = append(add, []string{"adduser", "-S", "-D", "-H", "-h", home, "-s", nologin, "-G", group, user})
+		} else {
+			add = append(add, []string{"useradd", "--system", "--gid", group, "--home-dir", home,
+				"--no-create-home", "--shell", nologin, user})
+		}
+	}
+	if ours {
+		if busybox {
+			del = append(del, []string{"deluser", user})
+		} else {
+			del = append(del, []string{"userdel", user})
+		}
+		if !groupExists || group == user {
+			if busybox {
+				del = append(del, []string{"delgroup", group})
+			} else {
+				del = append(del, []string{"groupdel", group})
+			}
+		}
+	}
+	return add, del
+}
@@ -0,0 +1,100 @@
+package servicelib
+
+import (
+	"bytes"
+	"encoding/xml"
+	"regexp"
+	"strconv"
+	"text/template"
+)
+
+var launchdPlistTemplate = template.Must(template.New("launchd").Funcs(template.FuncMap{
+	"xml": func(s string) string {
+		var b bytes.Buffer
+		xml.EscapeText(&b, []byte(s))
+		return b.String()
+	},
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{xml .Name}}</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>{{xml .Exe}}</string>
+		<string>run</string>
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+</dict>
+</plist>
+`))
+
+// launchdBackend installs a launch daemon plist, loaded by start.
+type launchdBackend struct {
+	host *Host
+}
+
+func (this *launchdBackend) Name() string {
+	return "launchd"
+}
+
+func (this *launchdBackend) Detect() bool {
+	return this.host.exists("/Library/LaunchDaemons")
+}
+
+func (this *launchdBackend) plistPath() string {
+	return "/Library/LaunchDaemons/" + this.host.Name + ".plist"
+}
+
+func (this *launchdBackend) Files() ([]InstallFile, error) {
+	var plist bytes.Buffer
+	if err := launchdPlistTemplate.Execute(&plist, this.host); err != nil {
+		return nil, err
+	}
+	return []InstallFile{{Path: this.plistPath(), Mode: 0644, Data: plist.Bytes()}}, nil
+}
+
+// Commands leave loading the plist to start.
+func (this *launchdBackend) Commands() Commands {
+	return Commands{Remove: [][]string{{"launchctl", "unload", this.plistPath()}}}
+}
+
+func (this *launchdBackend) Installed() bool {
+	return this.host.exists(this.plistPath())
+}
+
+func (this *launchdBackend) Start() error {
+	if !this.Installed() {
+		return this.host.errNotInstalled(this.Name())
+	}
+	return this.host.command("launchctl", "load", this.host.Path(this.plistPath()))
+}
+
+func (this *launchdBackend) Stop() error {
+	if !this.Installed() {
+		return this.host.errNotRunning()
+	}
+	return this.host.command("launchctl", "unload", this.host.Path(this.plistPath()))
+}
+
+var launchdPidRe = regexp.MustCompile(`"PID" = ([0-9]+);`)
+
+func (this *launchdBackend) MainPid() (int, bool) {
+	out, err := this.host.Run("launchctl", "list", this.host.Name)
+	if err != nil {
+		return 0, false
+	}
+	m := launchdPidRe.FindSubmatch(out)
+	if m == nil {
+		return 0, false
+	}
+	pid, _ := strconv.Atoi(string(m[1]))
+	return pid, pid > 0
+}
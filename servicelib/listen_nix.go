@@ -0,0 +1,85 @@
+// +build linux darwin
+
+package servicelib
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// socketActivated is set once the daemon serves sockets owned by
+// systemd, so an upgrade can tell the new process.
+var socketActivated bool
+
+// Listeners returns the sockets the daemon should accept on: those
+// handed down by Upgrade, those passed in by systemd socket activation,
+// or else a new one bound to addr. activated reports whether systemd
+// owns the sockets, in which case the daemon cannot rebind them.
+func Listeners(network, addr string) (listeners []net.Listener, activated bool, err error) {
+	listeners, err = inheritedListeners()
+	if listeners != nil || err != nil {
+		return listeners, socketActivated, err
+	}
+	listeners, err = activationListeners()
+	if listeners != nil || err != nil {
+		socketActivated = err == nil
+		return listeners, socketActivated, err
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, false, err
+	}
+	return []net.Listener{l}, false, nil
+}
+
+// activationListeners adopts the sockets systemd passes following the
+// sd_listen_fds(3) protocol: LISTEN_FDS sockets starting at fd 3, meant
+// for the process in LISTEN_PID and named in LISTEN_FDNAMES.
+func activationListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// they are not meant for our children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	return filesListeners(3, n, names)
+}
+
+// filesListeners turns n consecutive fds starting at first into
+// listeners. Fds that are not stream sockets are logged and skipped.
+func filesListeners(first, n int, names []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		fd := first + i
+		name := fmt.Sprintf("fd%d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Printf("Listeners: skipping passed socket %s: %v\r\n", name, err)
+			continue
+		}
+		log.Printf("Listeners: adopted socket %s on %s\r\n", name, l.Addr())
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("none of the %d passed sockets can be listened on", n)
+	}
+	return listeners, nil
+}
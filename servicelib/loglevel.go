@@ -0,0 +1,46 @@
+package servicelib
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// Log levels the daemon runs at. At LogInfo the log has what the daemon
+// does; LogDebug adds what every client sends.
+const (
+	LogDebug = "debug"
+	LogInfo  = "info"
+)
+
+// debugLogging is 1 at LogDebug. Client handlers check it for every
+// read, hence no lock.
+var debugLogging int32
+
+// SetLogLevel switches the log to level, LogDebug or LogInfo.
+func SetLogLevel(level string) error {
+	switch level {
+	case LogDebug:
+		atomic.StoreInt32(&debugLogging, 1)
+	case LogInfo:
+		atomic.StoreInt32(&debugLogging, 0)
+	default:
+		return fmt.Errorf("unknown log level %q, use %s or %s", level, LogDebug, LogInfo)
+	}
+	return nil
+}
+
+// LogLevel returns the level the log is at.
+func LogLevel() string {
+	if atomic.LoadInt32(&debugLogging) == 1 {
+		return LogDebug
+	}
+	return LogInfo
+}
+
+// Debugf logs like log.Printf, at LogDebug only.
+func Debugf(format string, v ...interface{}) {
+	if atomic.LoadInt32(&debugLogging) == 1 {
+		log.Printf(format, v...)
+	}
+}
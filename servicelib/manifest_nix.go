@@ -0,0 +1,351 @@
+// +build linux darwin
+
+package servicelib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/oliveagle/ole_tryout_daemon/config"
+	"github.com/spf13/viper"
+)
+
+// Manifest records what install put on the system, so remove can take
+// exactly that away again, also after the config changed. install
+// --dry-run prints it instead of installing.
+type Manifest struct {
+	Name    string `json:"name"`
+	Backend string `json:"backend"`
+	// Root is the directory the files went below, / unless staged.
+	Root  string         `json:"root"`
+	Files []ManifestFile `json:"files"`
+	// Commands were only run when Root is /.
+	Commands Commands `json:"commands"`
+}
+
+// ManifestFile is one file, directory or link install created.
+type ManifestFile struct {
+	Path string `json:"path"`
+	// Type is file, dir or symlink.
+	Type string `json:"type"`
+	Mode string `json:"mode,omitempty"`
+	// SHA256 is the content of a file as installed; remove keeps a
+	// file that was changed since.
+	SHA256 string `json:"sha256,omitempty"`
+	Source string `json:"source,omitempty"`
+	Link   string `json:"link,omitempty"`
+	// Purge marks a directory remove --purge deletes with its contents.
+	Purge bool `json:"purge,omitempty"`
+	// Keep marks a file only remove --purge deletes, like the config.
+	Keep bool `json:"keep,omitempty"`
+}
+
+// manifestPath is where install keeps the manifest: with the daemon's
+// other state, in the user's state directory for a user install.
+func manifestPath(name string, user bool) string {
+	if user {
+		return filepath.Join(config.UserStateDir(), name, "install.json")
+	}
+	return filepath.Join("/var/lib", name, "install.json")
+}
+
+var defaultConfigTemplate = template.Must(template.New("config").Funcs(template.FuncMap{
+	"toml": tomlString,
+}).Parse(`# written by {{.Name}} install, with the settings it was installed with
+
+msg = {{toml .Msg}}
+
+[log]
+logpath = {{toml .LogPath}}
+
+[daemon]
+listen = {{toml .Listen}}
+pidfile = {{toml .PidFile}}
+statefile = {{toml .StateFile}}
+control_socket = {{toml .ControlSocket}}
+
+[service]
+user = {{toml .User}}
+group = {{toml .Group}}
+`))
+
+// tomlString quotes s as a TOML basic string.
+func tomlString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, "\\u%04x", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// defaultConfig returns the config install puts in /etc: the file in
+// use, or one written from the settings in effect when there is none.
+func defaultConfig(name string) ([]byte, error) {
+	if used := viper.ConfigFileUsed(); used != "" {
+		return ioutil.ReadFile(used)
+	}
+	var conf bytes.Buffer
+	err := defaultConfigTemplate.Execute(&conf, map[string]string{
+		"Name":          name,
+		"Msg":           viper.GetString("msg"),
+		"LogPath":       viper.GetString("log.logpath"),
+		"Listen":        viper.GetString("daemon.listen"),
+		"PidFile":       viper.GetString("daemon.pidfile"),
+		"StateFile":     viper.GetString("daemon.statefile"),
+		"ControlSocket": viper.GetString("daemon.control_socket"),
+		"User":          viper.GetString("service.user"),
+		"Group":         viper.GetString("service.group"),
+	})
+	return conf.Bytes(), err
+}
+
+// installPlan lists everything install puts in place and runs: the
+// binary, the default config unless there is one already, the system
+// account the service runs as, and the log and state directories owned
+// by it, then the init system's files and commands. The service
+// definitions start the installed binary, so host.Exe is pointed at it
+// first. A user install leaves the binary and config where they are and
+// runs as the user.
+func (this *Service) installPlan(host *Host, backend IServiceManager, user bool) ([]InstallFile, Commands, error) {
+	var files []InstallFile
+	var cmds Commands
+	var dirs []string
+	if !user {
+		bin := binPath(host.Name)
+		if !samePath(host.Exe, host.Path(bin)) {
+			files = append(files, InstallFile{Path: bin, Mode: 0755, Source: host.Exe})
+		}
+		host.Exe = bin
+
+		conf := filepath.Join("/etc", host.Name, "config.toml")
+		if !host.exists(conf) {
+			data, err := defaultConfig(host.Name)
+			if err != nil {
+				return nil, cmds, err
+			}
+			files = append(files, InstallFile{Path: conf, Mode: 0644, Data: data, NoReplace: true})
+		}
+		files = append([]InstallFile{{Path: filepath.Dir(conf), Mode: os.ModeDir | 0755, Purge: true}}, files...)
+	}
+	if dir := viper.GetString("log.logpath"); dir != "" {
+		dirs = append(dirs, dir)
+	}
+	dirs = append(dirs, filepath.Dir(manifestPath(host.Name, user)))
+	for _, dir := range dirs {
+		// only a directory of our own is purged, not e.g. /var/log
+		purge := filepath.Base(dir) == host.Name
+		files = append(files, InstallFile{Path: dir, Mode: os.ModeDir | 0755, Purge: purge})
+	}
+
+	if owner := viper.GetString("service.user"); owner != "" && !user {
+		group := viper.GetString("service.group")
+		if group == "" {
+			group = owner
+		}
+		cmds.Install, cmds.Purge = host.accountCommands(owner, group, filepath.Dir(manifestPath(host.Name, false)))
+		for _, dir := range dirs {
+			cmds.Install = append(cmds.Install, []string{"chown", owner + ":" + group, dir})
+		}
+	}
+
+	more, err := backend.Files()
+	if err != nil {
+		return nil, cmds, err
+	}
+	files = append(files, more...)
+	backendCmds := backend.Commands()
+	cmds.Install = append(cmds.Install, backendCmds.Install...)
+	cmds.Remove = backendCmds.Remove
+	cmds.Cleanup = backendCmds.Cleanup
+	cmds.Purge = append(backendCmds.Purge, cmds.Purge...)
+	return files, cmds, nil
+}
+
+// lookupAccount finds the user, or with group set the group, called
+// name, and returns the user's home directory. Below a staging root we
+// look in its own passwd and group files.
+func (this *Host) lookupAccount(name string, group bool) (string, bool) {
+	if !this.staged() {
+		if group {
+			_, err := user.LookupGroup(name)
+			return "", err == nil
+		}
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", false
+		}
+		return u.HomeDir, true
+	}
+	db := "/etc/passwd"
+	if group {
+		db = "/etc/group"
+	}
+	data, err := ioutil.ReadFile(this.Path(db))
+	if err != nil {
+		return "", false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if fields[0] != name {
+			continue
+		}
+		if len(fields) > 5 {
+			return fields[5], true
+		}
+		return "", true
+	}
+	return "", false
+}
+
+// binPath is where install copies the binary to.
+func binPath(name string) string {
+	dir := viper.GetString("install.bin_dir")
+	if dir == "" {
+		dir = "/usr/local/bin"
+	}
+	return filepath.Join(dir, name)
+}
+
+// samePath reports whether a and b name the same existing file.
+func samePath(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	return err == nil && os.SameFile(fa, fb)
+}
+
+// newManifest plans installing files. Directories and kept files that
+// are there already are not ours to remove later and are left out,
+// unless purge is to delete them; missing parent directories are put
+// in.
+func newManifest(host *Host, backend IServiceManager, files []InstallFile, cmds Commands) (*Manifest, error) {
+	m := &Manifest{Name: host.Name, Backend: backend.Name(), Root: host.Root, Commands: cmds}
+	planned := map[string]bool{}
+	for _, f := range files {
+		var parents []string
+		for dir := filepath.Dir(f.Path); dir != "/" && !planned[dir] && !host.exists(dir); dir = filepath.Dir(dir) {
+			parents = append([]string{dir}, parents...)
+		}
+		for _, dir := range parents {
+			planned[dir] = true
+			m.Files = append(m.Files, ManifestFile{Path: dir, Type: "dir", Mode: "0755"})
+		}
+		if planned[f.Path] || (f.Mode&(os.ModeDir|os.ModeSymlink) == os.ModeDir && !f.Purge || f.NoReplace) && host.exists(f.Path) {
+			continue
+		}
+		planned[f.Path] = true
+		entry, err := manifestFile(f)
+		if err != nil {
+			return nil, err
+		}
+		m.Files = append(m.Files, entry)
+	}
+	return m, nil
+}
+
+func manifestFile(f InstallFile) (ManifestFile, error) {
+	entry := ManifestFile{Path: f.Path, Mode: fmt.Sprintf("%04o", f.Mode.Perm()), Purge: f.Purge}
+	switch {
+	case f.Mode&os.ModeDir != 0:
+		entry.Type = "dir"
+	case f.Mode&os.ModeSymlink != 0:
+		entry.Type, entry.Mode, entry.Link = "symlink", "", f.Link
+	default:
+		// a file install does not replace is the admin's once there
+		entry.Type, entry.Source, entry.Keep = "file", f.Source, f.NoReplace
+		data := f.Data
+		if f.Source != "" {
+			var err error
+			if data, err = ioutil.ReadFile(f.Source); err != nil {
+				return entry, err
+			}
+		}
+		sum := sha256.Sum256(data)
+		entry.SHA256 = hex.EncodeToString(sum[:])
+	}
+	return entry, nil
+}
+
+// readManifest loads the manifest install left at path.
+func readManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// Write writes the manifest to w as JSON.
+func (this *Manifest) Write(w io.Writer) error {
+	data, err := json.MarshalIndent(this, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// removeFiles deletes what the manifest lists in reverse order, so
+// directories are empty by the time their turn comes. A directory that
+// still holds something we did not put there is left alone, and so is a
+// file to keep or a file or link that was changed after install, unless
+// purge is set.
+func (this *Host) removeFiles(files []ManifestFile, purge bool) {
+	for i := len(files) - 1; i >= 0; i-- {
+		f := files[i]
+		path := this.Path(f.Path)
+		if purge {
+			if f.Purge {
+				os.RemoveAll(path)
+			} else {
+				os.Remove(path)
+			}
+			continue
+		}
+		switch f.Type {
+		case "file":
+			if f.Keep {
+				continue
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			if sum := sha256.Sum256(data); f.SHA256 != "" && hex.EncodeToString(sum[:]) != f.SHA256 {
+				fmt.Printf("keeping %s, it changed since install\n", path)
+				continue
+			}
+		case "symlink":
+			if link, err := os.Readlink(path); err != nil || link != f.Link {
+				continue
+			}
+		}
+		os.Remove(path)
+	}
+}
@@ -0,0 +1,132 @@
+// +build linux darwin
+
+package servicelib
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/oliveagle/ole_tryout_daemon/config"
+	"github.com/spf13/viper"
+)
+
+// TestDefaultConfig checks the config install writes sets every path the
+// daemon uses, so the daemon and the CLI agree on them once it is in /etc.
+func TestDefaultConfig(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	t.Setenv(config.CONF_ENV, "")
+	config.SetDefault()
+	if used := viper.ConfigFileUsed(); used != "" {
+		t.Skipf("%s is used instead of the defaults", used)
+	}
+
+	data, err := defaultConfig("oleservice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := viper.New()
+	written.SetConfigType("toml")
+	if err := written.ReadConfig(bytes.NewReader(data)); err != nil {
+		t.Fatalf("%v in\n%s", err, data)
+	}
+	for _, key := range viper.AllKeys() {
+		if !strings.HasPrefix(key, "log.") && !strings.HasPrefix(key, "daemon.") {
+			continue
+		}
+		path := viper.GetString(key)
+		if !filepath.IsAbs(path) {
+			continue
+		}
+		if !written.IsSet(key) {
+			t.Errorf("%s is missing, want %s", key, path)
+		} else if got := written.GetString(key); got != path {
+			t.Errorf("%s = %s, want %s", key, got, path)
+		}
+	}
+}
+
+// TestRemoveKeepsConfig stages an install below a root and removes it:
+// only remove --purge deletes the config, even one left as installed.
+func TestRemoveKeepsConfig(t *testing.T) {
+	for _, purge := range []bool{false, true} {
+		viper.Reset()
+		t.Cleanup(viper.Reset)
+		viper.Set("log.logpath", "/var/log/oleservice")
+		viper.Set("daemon.pidfile", "/var/run/oleservice/oleservice.pid")
+
+		srv := NewService("oleservice", "ole service description", nil)
+		srv.Root, srv.Backend, srv.Purge = t.TempDir(), "nohup", purge
+		if err := srv.InstallService(); err != nil {
+			t.Fatal(err)
+		}
+		conf := filepath.Join(srv.Root, "/etc/oleservice/config.toml")
+		bin := filepath.Join(srv.Root, "/usr/local/bin/oleservice")
+		for _, path := range []string{conf, bin} {
+			if _, err := os.Stat(path); err != nil {
+				t.Fatalf("not installed: %v", err)
+			}
+		}
+		if err := srv.RemoveService(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(bin); !os.IsNotExist(err) {
+			t.Errorf("purge %v: binary left behind: %v", purge, err)
+		}
+		if _, err := os.Stat(conf); purge == os.IsNotExist(err) {
+			continue
+		}
+		if purge {
+			t.Errorf("remove --purge kept %s", conf)
+		} else {
+			t.Errorf("remove deleted %s", conf)
+		}
+	}
+}
+
+// TestDefaultConfigQuoting checks values that need escaping in TOML
+// come back from the written config as they went in.
+func TestDefaultConfigQuoting(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	want := map[string]string{
+		"msg":                   `say "hi"` + "\t\\o/",
+		"log.logpath":           `C:\ole service\logs`,
+		"daemon.listen":         "127.0.0.1:9977",
+		"daemon.pidfile":        `/var/run/ole"service/oleservice.pid`,
+		"daemon.statefile":      "/var/run/oleservice/ole\nservice.state",
+		"daemon.control_socket": `/run/oleservice/\control.sock`,
+	}
+	for key, value := range want {
+		viper.Set(key, value)
+	}
+	data, err := defaultConfig("oleservice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(config.CONF_ENV, file)
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("%v in\n%s", err, data)
+	}
+	got := map[string]string{
+		"msg":                   cfg.Msg,
+		"log.logpath":           cfg.LogPath,
+		"daemon.listen":         cfg.Listen,
+		"daemon.pidfile":        cfg.PidFile,
+		"daemon.statefile":      cfg.StateFile,
+		"daemon.control_socket": cfg.ControlSocket,
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %q, want %q", key, got[key], value)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// +build linux darwin
+
+package servicelib
+
+import (
+	"fmt"
+)
+
+// nohupBackend is the fallback for machines without an init system we
+// know, e.g. containers. Nothing but the binary and config gets
+// installed; start detaches the daemon from the terminal, and its pid
+// file is all there is to find it again.
+type nohupBackend struct {
+	host *Host
+}
+
+func (this *nohupBackend) Name() string {
+	return "nohup"
+}
+
+func (this *nohupBackend) Detect() bool {
+	return true
+}
+
+func (this *nohupBackend) Files() ([]InstallFile, error) {
+	return nil, nil
+}
+
+func (this *nohupBackend) Commands() Commands {
+	return Commands{}
+}
+
+func (this *nohupBackend) Installed() bool {
+	return false
+}
+
+// Start detaches the daemon from us, see detach.
+func (this *nohupBackend) Start() error {
+	pid, err := this.host.detach()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s started as pid %d\n", this.host.Name, pid)
+	return nil
+}
+
+// Stop is only called without a running daemon to signal; StopService
+// signals the pid in the pid file itself.
+func (this *nohupBackend) Stop() error {
+	return this.host.errNotRunning()
+}
+
+func (this *nohupBackend) MainPid() (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,42 @@
+// +build linux darwin
+
+package servicelib
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// SdNotify sends state, one or more newline separated assignments such
+// as READY=1, to the service manager over $NOTIFY_SOCKET; see
+// sd_notify(3). It does nothing when we were not started by systemd.
+func SdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// a leading @ names an abstract socket, which net handles for us
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// WatchdogInterval returns how often to send WATCHDOG=1, half the
+// timeout systemd passed in $WATCHDOG_USEC, or 0 when the watchdog is
+// off or meant for another process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
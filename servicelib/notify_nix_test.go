@@ -0,0 +1,87 @@
+// +build linux darwin
+
+package servicelib
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listenNotify binds a unixgram socket at addr and points NOTIFY_SOCKET
+// at it, like systemd does for the services it starts.
+func listenNotify(t *testing.T, addr string) *net.UnixConn {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", addr)
+	return conn
+}
+
+func readDatagram(t *testing.T, conn *net.UnixConn) string {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no datagram: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	addrs := map[string]string{"path": filepath.Join(t.TempDir(), "notify.sock")}
+	if runtime.GOOS == "linux" {
+		addrs["abstract"] = fmt.Sprintf("@oleservice-test-%d", os.Getpid())
+	}
+	states := []string{"READY=1", "STOPPING=1", "STATUS=Serving 2 connections on [::]:9977", "MAINPID=4242"}
+	for name, addr := range addrs {
+		t.Run(name, func(t *testing.T) {
+			conn := listenNotify(t, addr)
+			for _, state := range states {
+				if err := SdNotify(state); err != nil {
+					t.Fatalf("SdNotify(%q): %v", state, err)
+				}
+				if got := readDatagram(t, conn); got != state {
+					t.Errorf("got datagram %q, want %q", got, state)
+				}
+			}
+		})
+	}
+}
+
+func TestSdNotifyWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := SdNotify("READY=1"); err != nil {
+		t.Errorf("SdNotify without NOTIFY_SOCKET: %v", err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	self := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+	}{
+		{"", "", 0},
+		{"0", "", 0},
+		{"garbage", "", 0},
+		{"10000000", "", 5 * time.Second},
+		{"10000000", self, 5 * time.Second},
+		{"3000000", self, 1500 * time.Millisecond},
+		{"10000000", strconv.Itoa(os.Getpid() + 1), 0},
+	}
+	for _, test := range tests {
+		t.Setenv("WATCHDOG_USEC", test.usec)
+		t.Setenv("WATCHDOG_PID", test.pid)
+		if got := WatchdogInterval(); got != test.want {
+			t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: got %v, want %v", test.usec, test.pid, got, test.want)
+		}
+	}
+}
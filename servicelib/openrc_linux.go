@@ -0,0 +1,150 @@
+package servicelib
+
+import (
+	"bytes"
+	"path/filepath"
+	"text/template"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var openrcScriptTemplate = template.Must(template.New("openrc").Parse(`#!/sbin/openrc-run
+
+name="{{.Name}}"
+description="{{.Desc}}"
+
+command="{{.Exe}}"
+command_args="run"
+command_background=true
+pidfile="{{.PidFile}}"
+{{- with .User}}
+command_user="{{.}}"
+{{- end}}
+# the daemon gets its drain timeout to close connections, and then some
+retry="TERM/{{.StopTimeout}}/KILL/5"
+
+extra_started_commands="reload"
+
+depend() {
+	need net{{range .Dependencies}} {{.}}{{end}}
+	use dns logger
+}
+{{- if .User}}
+
+start_pre() {
+	# start-stop-daemon writes the pid file as root, the daemon rewrites
+	# it as command_user
+{{- with .PidDir}}
+	checkpath --directory --owner "$command_user" --mode 0755 "{{.}}"
+{{- end}}
+	checkpath --file --owner "$command_user" --mode 0644 "$pidfile"
+}
+{{- end}}
+
+reload() {
+	ebegin "Reloading ${RC_SVCNAME}"
+	start-stop-daemon --signal HUP --pidfile "$pidfile"
+	eend $?
+}
+`))
+
+// openrcScript generates the openrc-run script. start-stop-daemon keeps
+// the daemon's own pid file, which the daemon takes over when it
+// finds it holds its pid already.
+func openrcScript(host *Host) ([]byte, error) {
+	opts, err := unitOptions()
+	if err != nil {
+		return nil, err
+	}
+	user := opts.User
+	if user != "" && opts.Group != "" {
+		user += ":" + opts.Group
+	}
+	// the directory the pid file has to itself goes to the user
+	pidDir := ""
+	if opts.RuntimeDirectory != "" {
+		pidDir = filepath.Dir(PidFilePath(host.Name))
+	}
+	var script bytes.Buffer
+	err = openrcScriptTemplate.Execute(&script, struct {
+		*Host
+		User         string
+		Dependencies []string
+		PidFile      string
+		StopTimeout  int
+		PidDir       string
+	}{
+		Host:         host,
+		User:         user,
+		Dependencies: opts.Dependencies,
+		PidFile:      PidFilePath(host.Name),
+		StopTimeout:  int((viper.GetDuration("daemon.drain_timeout") + 10*time.Second).Seconds()),
+		PidDir:       pidDir,
+	})
+	return script.Bytes(), err
+}
+
+// openrcBackend installs an openrc-run script and adds it to the default
+// runlevel.
+type openrcBackend struct {
+	host *Host
+}
+
+func (this *openrcBackend) Name() string {
+	return "openrc"
+}
+
+func (this *openrcBackend) Detect() bool {
+	return this.host.exists("/run/openrc") || this.host.exists("/sbin/openrc-run")
+}
+
+func (this *openrcBackend) scriptPath() string {
+	return "/etc/init.d/" + this.host.Name
+}
+
+func (this *openrcBackend) Files() ([]InstallFile, error) {
+	script, err := openrcScript(this.host)
+	if err != nil {
+		return nil, err
+	}
+	return []InstallFile{{Path: this.scriptPath(), Mode: 0755, Data: script}}, nil
+}
+
+func (this *openrcBackend) Commands() Commands {
+	return Commands{
+		Install: [][]string{{"rc-update", "add", this.host.Name, "default"}},
+		Remove: [][]string{
+			{"rc-service", this.host.Name, "stop"},
+			{"rc-update", "del", this.host.Name, "default"},
+		},
+	}
+}
+
+func (this *openrcBackend) Installed() bool {
+	return this.host.exists(this.scriptPath())
+}
+
+func (this *openrcBackend) Start() error {
+	if !this.Installed() {
+		return this.host.errNotInstalled(this.Name())
+	}
+	return this.host.command("rc-service", this.host.Name, "start")
+}
+
+func (this *openrcBackend) Stop() error {
+	if !this.Installed() {
+		return this.host.errNotRunning()
+	}
+	return this.host.command("rc-service", this.host.Name, "stop")
+}
+
+// MainPid returns the daemon's pid while openrc has the service started,
+// so stop goes through rc-service and openrc does not think it crashed.
+func (this *openrcBackend) MainPid() (int, bool) {
+	if _, err := this.host.Run("rc-service", this.host.Name, "status"); err != nil {
+		return 0, false
+	}
+	pid, locked, err := ReadPidFile(PidFilePath(this.host.Name))
+	return pid, err == nil && locked
+}
@@ -0,0 +1,202 @@
+// +build linux darwin
+
+package servicelib
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// PidFilePath returns the file the daemon records its process id in,
+// taken from daemon.pidfile in the config.
+func PidFilePath(name string) string {
+	if path := viper.GetString("daemon.pidfile"); path != "" {
+		return path
+	}
+	return "/var/run/" + name + ".pid"
+}
+
+// PidFile is a pid file held with an exclusive flock for as long as the
+// daemon runs. The lock, not the file's existence, is what marks the
+// daemon as running: a crashed daemon leaves the file behind but the
+// kernel drops its lock.
+type PidFile struct {
+	path string
+	file *os.File
+	// inherited is set when a process we upgrade from handed it to us
+	inherited bool
+}
+
+// CreatePidFile locks path and records the current pid in it. It fails
+// if another live process holds the lock, and takes over a file left
+// behind by a daemon that died without cleaning up. A process started
+// by Upgrade takes over its parent's locked file instead.
+func CreatePidFile(path string) (*PidFile, error) {
+	if pidfile, ok, err := inheritedPidFile(path); ok {
+		return pidfile, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == syscall.EWOULDBLOCK {
+			pid, _ := readPid(f)
+			f.Close()
+			return nil, fmt.Errorf("already running as pid %d (pid file %s)", pid, path)
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("could not lock pid file %s: %v", path, err)
+		}
+
+		// the previous owner may have removed the file between our open
+		// and our lock, in which case we locked an orphaned inode
+		if !sameFile(f, path) {
+			f.Close()
+			continue
+		}
+
+		if pid, err := readPid(f); err == nil && pid != os.Getpid() {
+			log.Printf("CreatePidFile: taking over stale pid file %s (pid %d)\r\n", path, pid)
+		}
+		if err := writePid(f, os.Getpid()); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &PidFile{path: path, file: f}, nil
+	}
+}
+
+// Path returns the location of the pid file.
+func (this *PidFile) Path() string {
+	return this.path
+}
+
+// Remove deletes the pid file and releases its lock. After a successful
+// Upgrade the file belongs to the new process and is left alone. Only
+// the first call does anything.
+func (this *PidFile) Remove() error {
+	if this.file == nil {
+		return nil
+	}
+	defer func() {
+		this.file.Close()
+		this.file = nil
+	}()
+	if this.inherited && os.Getenv(readyFdEnv) != "" {
+		// we never took over, the parent waiting for us takes it back
+		return nil
+	}
+	if pid, err := readPid(this.file); err == nil && pid != os.Getpid() {
+		return nil
+	}
+	err := os.Remove(this.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ReadPidFile returns the process id recorded in path and whether a live
+// process still holds the lock on it.
+func ReadPidFile(path string) (int, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	pid, err := readPid(f)
+	if err != nil {
+		return 0, false, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return pid, true, nil
+	}
+	if err != nil {
+		return pid, false, err
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return pid, false, nil
+}
+
+func readPid(f *os.File) (int, error) {
+	buf := make([]byte, 32)
+	n, err := f.ReadAt(buf, 0)
+	if n == 0 && err != nil {
+		return 0, fmt.Errorf("pid file %s is empty", f.Name())
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("pid file %s is corrupt", f.Name())
+	}
+	return pid, nil
+}
+
+func writePid(f *os.File, pid int) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt([]byte(fmt.Sprintf("%d\n", pid)), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func sameFile(f *os.File, path string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	pi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi, pi)
+}
+
+// processAlive reports whether a process with the given pid exists.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// runningPid returns the pid of the running daemon, or an error when
+// the daemon is not running.
+func (this *Service) runningPid() (int, error) {
+	path := PidFilePath(this.name)
+	pid, locked, err := ReadPidFile(path)
+	if os.IsNotExist(err) {
+		return 0, fmt.Errorf("service %s is not running", this.name)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !locked || !processAlive(pid) {
+		return 0, fmt.Errorf("service %s is not running (stale pid file %s for pid %d)", this.name, path, pid)
+	}
+	return pid, nil
+}
+
+// signalDaemon delivers sig to the running daemon.
+func (this *Service) signalDaemon(sig syscall.Signal) error {
+	pid, err := this.runningPid()
+	if err != nil {
+		return err
+	}
+	if err := syscall.Kill(pid, sig); err != nil {
+		return fmt.Errorf("could not signal %s (pid %d): %v", this.name, pid, err)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package servicelib
+
+import (
+	"syscall"
+)
+
+// setNoNewPrivs does nothing, macOS has no such thing.
+func setNoNewPrivs() error {
+	return nil
+}
+
+// keepNetBindCap does nothing, any user may bind low ports on macOS.
+func keepNetBindCap(attr *syscall.SysProcAttr) {
+}
+
+func currentPrivs() (caps []string, noNewPrivs bool) {
+	return nil, false
+}
+
+func checkPrivs(keepNetBind bool) error {
+	return nil
+}
@@ -0,0 +1,82 @@
+package servicelib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	prSetNoNewPrivs       = 38
+	prGetNoNewPrivs       = 39
+	capNetBindService     = 10
+	capNetBindServiceName = "CAP_NET_BIND_SERVICE"
+)
+
+// setNoNewPrivs sets PR_SET_NO_NEW_PRIVS on the calling thread.
+func setNoNewPrivs() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// keepNetBindCap has the new process keep CAP_NET_BIND_SERVICE as an
+// ambient capability across the switch to another user and the exec.
+func keepNetBindCap(attr *syscall.SysProcAttr) {
+	attr.AmbientCaps = []uintptr{capNetBindService}
+}
+
+// procStatus reads the fields of /proc/self/status by name.
+func procStatus() map[string]string {
+	status := map[string]string{}
+	data, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return status
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 {
+			status[kv[0]] = strings.TrimSpace(kv[1])
+		}
+	}
+	return status
+}
+
+// currentPrivs reads our effective capabilities and no_new_privs from
+// /proc.
+func currentPrivs() (caps []string, noNewPrivs bool) {
+	status := procStatus()
+	mask, _ := strconv.ParseUint(status["CapEff"], 16, 64)
+	for bit := uint(0); bit < 64; bit++ {
+		if mask&(1<<bit) == 0 {
+			continue
+		}
+		if bit == capNetBindService {
+			caps = append(caps, capNetBindServiceName)
+		} else {
+			caps = append(caps, fmt.Sprintf("cap_%d", bit))
+		}
+	}
+	return caps, status["NoNewPrivs"] == "1"
+}
+
+// checkPrivs fails unless no_new_privs is set and the only capability
+// left is CAP_NET_BIND_SERVICE, when keepNetBind asked for it.
+func checkPrivs(keepNetBind bool) error {
+	caps, noNewPrivs := currentPrivs()
+	if !noNewPrivs {
+		return fmt.Errorf("no_new_privs is not set")
+	}
+	for _, c := range caps {
+		if c != capNetBindServiceName || !keepNetBind {
+			return fmt.Errorf("capabilities %v were not dropped", caps)
+		}
+	}
+	if keepNetBind && len(caps) == 0 {
+		return fmt.Errorf("%s was not kept", capNetBindServiceName)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// +build linux darwin
+
+package servicelib
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// droppedEnv tells the process DropPrivileges starts that it must find
+// itself without privileges.
+const droppedEnv = "OLESERVICE_DROPPED"
+
+// credentials are the ids of the account the daemon drops to.
+type credentials struct {
+	user  string
+	uid   int
+	group string
+	gid   int
+}
+
+// lookupCredentials finds the user, and the group or else the user's
+// primary group, as set in the config section.
+func lookupCredentials(section, userName, groupName string) (*credentials, error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return nil, fmt.Errorf("%s.user: %v", section, err)
+	}
+	cred := &credentials{user: u.Username}
+	cred.uid, _ = strconv.Atoi(u.Uid)
+	cred.gid, _ = strconv.Atoi(u.Gid)
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return nil, fmt.Errorf("%s.group: %v", section, err)
+		}
+		cred.gid, _ = strconv.Atoi(g.Gid)
+	}
+	cred.group = groupName
+	if g, err := user.LookupGroupId(strconv.Itoa(cred.gid)); err == nil {
+		cred.group = g.Name
+	}
+	return cred, nil
+}
+
+// DropPrivileges has the daemon carry on as userName, in groupName or
+// else the user's primary group, without supplementary groups, unable to
+// gain privileges through setuid binaries and, with keepNetBind, with
+// CAP_NET_BIND_SERVICE as its only capability. With sandbox set to
+// Landlock, it confines the copy on the way, see Sandbox.Apply.
+//
+// Running as root it starts a copy of the daemon as that account and
+// hands it the listeners and pid file like Upgrade does, after giving
+// the account the files and directories in owned. It returns the copy's
+// pid once the copy serves; the caller is done then. The copy, or a
+// daemon the init system started as the account already, gets 0 after
+// checking it has no privileges left that it should not have.
+func DropPrivileges(userName, groupName string, keepNetBind bool, sandbox *Sandbox, listeners []net.Listener,
+	pidfile *PidFile, timeout time.Duration, owned ...string) (int, error) {
+	cred, err := lookupCredentials("daemon", userName, groupName)
+	if err != nil {
+		return 0, err
+	}
+	if os.Geteuid() != 0 {
+		strict := os.Getenv(droppedEnv) != ""
+		os.Unsetenv(droppedEnv)
+		return 0, checkDropped(cred, keepNetBind, strict)
+	}
+
+	for _, path := range owned {
+		if err := os.Chown(path, cred.uid, cred.gid); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	// no_new_privs belongs to a thread, and the new process inherits it
+	// from the thread that forks it. Keep this goroutine on that thread,
+	// so nothing else runs there.
+	runtime.LockOSThread()
+	if err := setNoNewPrivs(); err != nil {
+		return 0, fmt.Errorf("could not set no_new_privs: %v", err)
+	}
+	attr := &syscall.SysProcAttr{
+		Credential: &syscall.Credential{
+			Uid: uint32(cred.uid),
+			Gid: uint32(cred.gid),
+			// clears the supplementary groups
+			Groups: []uint32{},
+		},
+	}
+	if keepNetBind {
+		keepNetBindCap(attr)
+	}
+	env := []string{droppedEnv + "=1"}
+	if sandbox != nil && sandbox.Landlock && os.Getenv(sandboxedEnv) == "" {
+		restricted, err := sandbox.restrictThread()
+		if err != nil {
+			return 0, err
+		}
+		if restricted {
+			env = append(env, sandboxedEnv+"=1")
+		}
+	}
+	return handOver(listeners, pidfile, timeout, attr, env...)
+}
+
+// checkDropped fails unless we run as cred. A process DropPrivileges
+// started, strict, must also have lost its groups, be unable to become
+// root again and hold no capabilities beyond CAP_NET_BIND_SERVICE when
+// keepNetBind asked for it.
+func checkDropped(cred *credentials, keepNetBind, strict bool) error {
+	if os.Getuid() != cred.uid || os.Geteuid() != cred.uid {
+		return fmt.Errorf("running as uid %d, not as %s (uid %d), and cannot switch without root",
+			os.Geteuid(), cred.user, cred.uid)
+	}
+	if os.Getgid() != cred.gid || os.Getegid() != cred.gid {
+		return fmt.Errorf("running as gid %d, not as %s (gid %d), and cannot switch without root",
+			os.Getegid(), cred.group, cred.gid)
+	}
+	if !strict {
+		return nil
+	}
+	groups, err := os.Getgroups()
+	if err != nil {
+		return err
+	}
+	for _, gid := range groups {
+		if gid != cred.gid {
+			return fmt.Errorf("supplementary groups %v were not cleared", groups)
+		}
+	}
+	if err := syscall.Setuid(0); err == nil {
+		return fmt.Errorf("could become root again after dropping privileges")
+	}
+	return checkPrivs(keepNetBind)
+}
+
+// CurrentIdentity describes who the daemon runs as, for status.
+func CurrentIdentity() *Identity {
+	id := &Identity{Uid: os.Geteuid(), Gid: os.Getegid()}
+	id.User, id.Group = strconv.Itoa(id.Uid), strconv.Itoa(id.Gid)
+	if u, err := user.LookupId(id.User); err == nil {
+		id.User = u.Username
+	}
+	if g, err := user.LookupGroupId(id.Group); err == nil {
+		id.Group = g.Name
+	}
+	if groups, err := os.Getgroups(); err == nil {
+		for _, gid := range groups {
+			if gid != id.Gid {
+				id.Groups = append(id.Groups, gid)
+			}
+		}
+	}
+	// root can do anything anyway
+	if id.Uid != 0 {
+		id.Caps, id.NoNewPrivs = currentPrivs()
+	}
+	return id
+}
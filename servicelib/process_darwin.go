@@ -0,0 +1,38 @@
+package servicelib
+
+import (
+	"log"
+	"syscall"
+)
+
+const (
+	rlimitNproc  = 7
+	rlimInfinity = 1<<63 - 1
+)
+
+// currentOOMScoreAdj finds nothing, macOS has no oom_score_adj.
+func currentOOMScoreAdj() *int {
+	return nil
+}
+
+func setOOMScoreAdj(adj int) error {
+	log.Printf("process: oom_score_adj is Linux only, ignoring it\r\n")
+	return nil
+}
+
+// currentUmask returns the umask Apply set: there is no reading it
+// without setting it, and other threads may be creating files.
+func currentUmask() (int, bool) {
+	return appliedUmask, appliedUmask >= 0
+}
+
+func currentNice() (int, error) {
+	return syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+}
+
+func setNice(nice int) error {
+	if cur, err := currentNice(); err == nil && cur == nice {
+		return nil
+	}
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, nice)
+}
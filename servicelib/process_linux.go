@@ -0,0 +1,83 @@
+package servicelib
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	rlimitNproc  = 6
+	rlimInfinity = ^uint64(0)
+)
+
+const oomScoreAdjPath = "/proc/self/oom_score_adj"
+
+func currentOOMScoreAdj() *int {
+	data, err := ioutil.ReadFile(oomScoreAdjPath)
+	if err != nil {
+		return nil
+	}
+	adj, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil
+	}
+	return &adj
+}
+
+func setOOMScoreAdj(adj int) error {
+	if cur := currentOOMScoreAdj(); cur != nil && *cur == adj {
+		return nil
+	}
+	return ioutil.WriteFile(oomScoreAdjPath, []byte(strconv.Itoa(adj)), 0644)
+}
+
+// currentUmask reads the umask from /proc; umask(2) only reads it by
+// setting it, under threads that may be creating files. Kernels before
+// 4.7 do not show it there, it is what Apply set then.
+func currentUmask() (int, bool) {
+	if umask, err := strconv.ParseUint(procStatus()["Umask"], 8, 32); err == nil {
+		return int(umask), true
+	}
+	return appliedUmask, appliedUmask >= 0
+}
+
+// currentNice returns the nice level of the calling thread. The system
+// call returns it as 20 - nice, to stay clear of error values.
+func currentNice() (int, error) {
+	prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	return 20 - prio, err
+}
+
+// setNice sets the nice level of every thread. Linux keeps one per
+// thread, and a new thread takes that of the one starting it; setting
+// it on the threads there are makes it stick.
+func setNice(nice int) error {
+	for {
+		tasks, err := ioutil.ReadDir("/proc/self/task")
+		if err != nil {
+			return err
+		}
+		changed := false
+		for _, task := range tasks {
+			tid, err := strconv.Atoi(task.Name())
+			if err != nil {
+				continue
+			}
+			prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, tid)
+			if err != nil || 20-prio == nice {
+				// gone already, or done
+				continue
+			}
+			if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice); err != nil && err != syscall.ESRCH {
+				return err
+			}
+			changed = true
+		}
+		// once more, for threads started meanwhile
+		if !changed {
+			return nil
+		}
+	}
+}
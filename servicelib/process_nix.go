@@ -0,0 +1,159 @@
+// +build linux darwin
+
+package servicelib
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"syscall"
+)
+
+// rlimits are the resource limits ProcessSettings sets, by the name the
+// config uses.
+var rlimits = map[string]int{
+	"nofile": syscall.RLIMIT_NOFILE,
+	"core":   syscall.RLIMIT_CORE,
+	"nproc":  rlimitNproc,
+	"as":     syscall.RLIMIT_AS,
+}
+
+// appliedUmask is the umask Apply set, -1 until it did.
+var appliedUmask = -1
+
+// ProcessSettings are what the daemon sets up for itself at start, ahead
+// of binding its listeners. Nil and empty fields leave what the daemon
+// was started with.
+type ProcessSettings struct {
+	// Limits sets the soft limit of nofile, core, nproc and as, and
+	// raises the hard limit to it; math.MaxUint64 is unlimited.
+	Limits           map[string]uint64
+	Umask            *int
+	WorkingDirectory string
+	OOMScoreAdj      *int
+	Nice             *int
+}
+
+// Apply puts the settings in place. What only root may do, raising a
+// hard limit, lowering the nice level or oom_score_adj, is skipped with
+// a warning in the log when we are not root, so a user's daemon can
+// share the config. Settings that are in place already are left alone,
+// for a daemon that inherited them from the one it upgrades from.
+func (this *ProcessSettings) Apply() error {
+	if this.Umask != nil {
+		syscall.Umask(*this.Umask)
+		appliedUmask = *this.Umask
+	}
+	if this.WorkingDirectory != "" {
+		if err := os.Chdir(this.WorkingDirectory); err != nil {
+			return err
+		}
+	}
+	var names []string
+	for name := range this.Limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := setLimit(name, this.Limits[name]); err != nil {
+			return err
+		}
+	}
+	if this.OOMScoreAdj != nil {
+		if err := setOOMScoreAdj(*this.OOMScoreAdj); err != nil {
+			if !os.IsPermission(err) {
+				return fmt.Errorf("oom_score_adj: %v", err)
+			}
+			log.Printf("process: not allowed to set oom_score_adj to %d: %v\r\n", *this.OOMScoreAdj, err)
+		}
+	}
+	if this.Nice != nil {
+		if err := setNice(*this.Nice); err != nil {
+			if err != syscall.EPERM && err != syscall.EACCES {
+				return fmt.Errorf("nice: %v", err)
+			}
+			log.Printf("process: not allowed to set nice level %d: %v\r\n", *this.Nice, err)
+		}
+	}
+	return nil
+}
+
+// setLimit sets the soft limit of the rlimit called name to value. Above
+// the hard limit it raises that too, or goes as far as the hard limit
+// when we may not; a lower hard limit could not be raised again.
+func setLimit(name string, value uint64) error {
+	resource, ok := rlimits[name]
+	if !ok {
+		return fmt.Errorf("unknown resource limit %s", name)
+	}
+	if value == math.MaxUint64 {
+		value = rlimInfinity
+	}
+	var cur syscall.Rlimit
+	if err := syscall.Getrlimit(resource, &cur); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	want := syscall.Rlimit{Cur: value, Max: cur.Max}
+	if value > cur.Max {
+		want.Max = value
+	}
+	if cur == want {
+		return nil
+	}
+	err := syscall.Setrlimit(resource, &want)
+	if err == syscall.EPERM && value > cur.Max {
+		log.Printf("process: not allowed to raise the %s hard limit to %s, staying at %s\r\n",
+			name, formatLimit(value), formatLimit(cur.Max))
+		want.Cur, want.Max = cur.Max, cur.Max
+		err = syscall.Setrlimit(resource, &want)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+func formatLimit(value uint64) string {
+	if value == rlimInfinity {
+		return "unlimited"
+	}
+	return fmt.Sprint(value)
+}
+
+// CurrentProcess describes the settings the daemon runs with, for
+// status.
+func CurrentProcess() *ProcessInfo {
+	info := &ProcessInfo{Limits: map[string]Limit{}, OOMScoreAdj: currentOOMScoreAdj()}
+	for name, resource := range rlimits {
+		var cur syscall.Rlimit
+		if syscall.Getrlimit(resource, &cur) != nil {
+			continue
+		}
+		info.Limits[name] = Limit{Soft: limitValue(cur.Cur), Hard: limitValue(cur.Max)}
+	}
+	info.Umask = "unknown"
+	if umask, ok := currentUmask(); ok {
+		info.Umask = fmt.Sprintf("%04o", umask)
+	}
+	info.WorkingDirectory, _ = os.Getwd()
+	info.Nice, _ = currentNice()
+	return info
+}
+
+func limitValue(value uint64) int64 {
+	if value == rlimInfinity || value > math.MaxInt64 {
+		return -1
+	}
+	return int64(value)
+}
+
+// OpenFilesLimit returns the soft limit on open files.
+func OpenFilesLimit() (uint64, bool) {
+	var cur syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &cur); err != nil || cur.Cur == rlimInfinity {
+		return 0, false
+	}
+	return cur.Cur, true
+}
@@ -0,0 +1,52 @@
+// +build linux darwin
+
+package servicelib
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestCurrentProcessUmask(t *testing.T) {
+	old := syscall.Umask(022)
+	t.Cleanup(func() {
+		syscall.Umask(old)
+		appliedUmask = -1
+	})
+	mask := 027
+	if err := (&ProcessSettings{Umask: &mask}).Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if got := CurrentProcess().Umask; got != "0027" {
+		t.Errorf("umask %s, want 0027", got)
+	}
+	// reading it leaves it alone
+	if cur := syscall.Umask(old); cur != mask {
+		t.Errorf("umask is %04o after reading it, want %04o", cur, mask)
+	}
+}
+
+func TestSetLimitKeepsHardLimit(t *testing.T) {
+	var old syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_CORE, &old); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Setrlimit(syscall.RLIMIT_CORE, &old) })
+	if old.Max == 0 {
+		t.Skip("the core hard limit is 0 already")
+	}
+	if err := setLimit("core", 0); err != nil {
+		t.Fatal(err)
+	}
+	var cur syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_CORE, &cur); err != nil {
+		t.Fatal(err)
+	}
+	if cur.Cur != 0 || cur.Max != old.Max {
+		t.Errorf("core limit %d/%d, want 0/%d", cur.Cur, cur.Max, old.Max)
+	}
+	// so it can be raised again
+	if err := setLimit("core", old.Max); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,57 @@
+package servicelib
+
+import (
+	"context"
+	"github.com/oliveagle/ole_tryout_daemon/config"
+	"net"
+)
+
+// Program is the work the daemon does. Register it with NewService; run
+// drives it from the signal loop on Unix and from the service control
+// manager on windows, and the control socket asks the same of it. The
+// calls never overlap.
+type Program interface {
+	// Start starts the work and returns; the daemon reports ready once
+	// it does. ctx is cancelled when the daemon stops.
+	Start(ctx context.Context) error
+	// Stop stops the work, finishing what is under way until ctx
+	// expires after daemon.drain_timeout.
+	Stop(ctx context.Context) error
+	// Pause and Continue hold and resume the work. A Program that
+	// fails to stays as it was.
+	Pause() error
+	Continue() error
+	// Reload takes on cfg, which has been validated, or rejects it
+	// with an error and keeps what it has; then the daemon keeps the
+	// old config as a whole.
+	Reload(cfg *config.Config) error
+}
+
+// ConnHandler is a Program that serves clients. Only for such a Program
+// the daemon listens on daemon.listen; it accepts the clients, turns
+// them away above daemon.max_connections and while paused, and drains
+// them when it stops. ServeConn serves one of them, in a goroutine of
+// its own, with the ctx Start got. The daemon closes conn once it
+// returns, and wakes it up with a read deadline when it stops.
+type ConnHandler interface {
+	ServeConn(ctx context.Context, conn net.Conn)
+}
+
+// Failing is a Program that can fail while it runs, like a Supervisor
+// whose components keep failing. The daemon stops once it reports an
+// error on Failed, and exits with it.
+type Failing interface {
+	Failed() <-chan error
+}
+
+// ComponentReporter is a Program with components, whose state status
+// shows, like a Supervisor.
+type ComponentReporter interface {
+	Components() []ComponentState
+}
+
+// ChildReporter is a Program that runs another program, whose state
+// status shows, like an Exec.
+type ChildReporter interface {
+	Child() *ChildState
+}
@@ -0,0 +1,26 @@
+package servicelib
+
+import (
+	"log"
+)
+
+// filterSyscalls does nothing, macOS has no seccomp.
+func (this *Sandbox) filterSyscalls() error {
+	log.Printf("sandbox: seccomp is Linux only, system calls are not restricted\r\n")
+	return nil
+}
+
+// restrictThread does nothing, macOS has no Landlock.
+func (this *Sandbox) restrictThread() (bool, error) {
+	log.Printf("sandbox: Landlock is Linux only, file access is not restricted\r\n")
+	return false, nil
+}
+
+// KernelFeatures reports seccomp and Landlock missing, they are Linux
+// only.
+func KernelFeatures() []Feature {
+	return []Feature{
+		{Name: "seccomp", Detail: "Linux only"},
+		{Name: "landlock", Detail: "Linux only"},
+	}
+}
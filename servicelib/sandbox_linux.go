@@ -0,0 +1,449 @@
+package servicelib
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// From linux/seccomp.h.
+const (
+	prGetSeccomp      = 21
+	seccompModeFilter = 2
+
+	seccompSetModeFilter   = 1
+	seccompGetActionAvail  = 2
+	seccompFlagTsync       = 1
+	seccompFlagNewListener = 8
+	seccompFlagTsyncEsrch  = 16
+
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetUserNotif   = 0x7fc00000
+	seccompRetLog         = 0x7ffc0000
+	seccompRetAllow       = 0x7fff0000
+
+	seccompUserNotifFlagContinue = 1
+	seccompIoctlNotifRecv        = 0xc0502100
+	seccompIoctlNotifSend        = 0xc0182101
+)
+
+// seccompNotif is struct seccomp_notif, a system call the filter handed
+// to us to decide on.
+type seccompNotif struct {
+	Id    uint64
+	Pid   uint32
+	Flags uint32
+	Nr    int32
+	Arch  uint32
+	Ip    uint64
+	Args  [6]uint64
+}
+
+// seccompNotifResp is struct seccomp_notif_resp, our answer to it.
+type seccompNotifResp struct {
+	Id    uint64
+	Val   int64
+	Error int32
+	Flags uint32
+}
+
+// From linux/landlock.h.
+const (
+	landlockCreateRulesetVersion = 1
+	landlockRulePathBeneath      = 1
+
+	landlockExecute    = 1 << 0
+	landlockWriteFile  = 1 << 1
+	landlockReadFile   = 1 << 2
+	landlockReadDir    = 1 << 3
+	landlockRemoveDir  = 1 << 4
+	landlockRemoveFile = 1 << 5
+	landlockMakeChar   = 1 << 6
+	landlockMakeDir    = 1 << 7
+	landlockMakeReg    = 1 << 8
+	landlockMakeSock   = 1 << 9
+	landlockMakeFifo   = 1 << 10
+	landlockMakeBlock  = 1 << 11
+	landlockMakeSym    = 1 << 12
+	// ABI 3
+	landlockTruncate = 1 << 14
+
+	// landlockAllV1 are the rights of the first ABI, all of which we
+	// take away
+	landlockAllV1 = 1<<13 - 1
+	// landlockFileRights are those that apply to a file, not a directory
+	landlockFileRights = landlockExecute | landlockWriteFile | landlockReadFile | landlockTruncate
+
+	landlockRead = landlockReadFile | landlockReadDir
+	landlockExec = landlockRead | landlockExecute
+
+	// oPath is O_PATH, which package syscall lacks
+	oPath = 0x200000
+)
+
+// landlockPathBeneath is struct landlock_path_beneath_attr. The kernel
+// reads it packed, 12 bytes, which the padding at the end leaves alone.
+type landlockPathBeneath struct {
+	AllowedAccess uint64
+	ParentFd      int32
+}
+
+// seccompAllowed are the system calls a network daemon makes: those of
+// the Go runtime, file and socket I/O, and starting a new copy of itself
+// for an upgrade. Those this architecture lacks are left out.
+var seccompAllowed = []string{
+	// runtime, memory, threads and signals
+	"brk", "mmap", "munmap", "mprotect", "madvise", "mremap",
+	"clone", "clone3", "exit", "exit_group", "futex", "set_robust_list",
+	"set_tid_address", "arch_prctl", "rseq", "sched_yield", "sched_getaffinity",
+	"rt_sigaction", "rt_sigprocmask", "rt_sigreturn", "sigaltstack",
+	"restart_syscall", "gettid", "getpid", "getppid", "tgkill", "tkill",
+	"kill", "nanosleep", "clock_gettime", "clock_getres",
+	"clock_nanosleep", "gettimeofday", "time", "getrandom", "uname",
+	"getrlimit", "prlimit64", "getrusage", "sysinfo", "prctl",
+	"getpriority", "setpriority",
+	// waiting for I/O
+	"epoll_create", "epoll_create1", "epoll_ctl", "epoll_wait",
+	"epoll_pwait", "epoll_pwait2", "eventfd2", "poll", "ppoll", "select",
+	"pselect6", "pipe", "pipe2",
+	// files: the log, the state and pid files and the config
+	"read", "write", "readv", "writev", "pread64", "pwrite64", "lseek",
+	"open", "openat", "close", "dup", "dup2", "dup3", "fcntl", "ioctl",
+	"stat", "fstat", "lstat", "newfstatat", "statx", "access",
+	"faccessat", "faccessat2", "readlink", "readlinkat", "getdents64",
+	"getcwd", "chdir", "flock", "ftruncate", "fsync", "fdatasync", "rename",
+	"renameat", "renameat2", "unlink", "unlinkat", "mkdir", "mkdirat",
+	"fchmod", "fchmodat", "umask",
+	// sockets
+	"socket", "socketpair", "bind", "listen", "accept", "accept4",
+	"connect", "getsockname", "getpeername", "setsockopt", "getsockopt",
+	"shutdown", "sendto", "recvfrom", "sendmsg", "recvmsg", "sendmmsg",
+	"recvmmsg", "sendfile", "splice",
+	// who we are
+	"getuid", "geteuid", "getgid", "getegid", "getgroups", "getresuid",
+	"getresgid", "capget",
+	// upgrades
+	"execve", "wait4", "waitid", "pidfd_open", "pidfd_send_signal",
+}
+
+// landlockSystemPaths are what the binary needs to read, besides its
+// config, to run at all and start an upgraded copy: the dynamic loader
+// and libraries, account and name lookups, time zones, and /proc for
+// the identity status reports.
+var landlockSystemPaths = map[string]uint64{
+	"/lib":                                landlockExec,
+	"/lib64":                              landlockExec,
+	"/usr/lib":                            landlockExec,
+	"/usr/lib64":                          landlockExec,
+	"/usr/local/lib":                      landlockExec,
+	"/etc/ld.so.cache":                    landlockRead,
+	"/etc/passwd":                         landlockRead,
+	"/etc/group":                          landlockRead,
+	"/etc/nsswitch.conf":                  landlockRead,
+	"/etc/hosts":                          landlockRead,
+	"/etc/host.conf":                      landlockRead,
+	"/etc/resolv.conf":                    landlockRead,
+	"/etc/gai.conf":                       landlockRead,
+	"/etc/localtime":                      landlockRead,
+	"/usr/share/zoneinfo":                 landlockRead,
+	"/proc":                               landlockRead,
+	"/sys/fs/cgroup":                      landlockRead,
+	"/sys/kernel/mm/transparent_hugepage": landlockRead,
+	"/dev/null":                           landlockRead | landlockWriteFile,
+}
+
+// syscallNumber looks up the system call called name.
+func syscallNumber(name string) (uint32, bool) {
+	for nr, n := range syscallNames {
+		if n == name {
+			return nr, true
+		}
+	}
+	return 0, false
+}
+
+// syscallName names system call nr for the log.
+func syscallName(nr int32) string {
+	if name, ok := syscallNames[uint32(nr)]; ok {
+		return name
+	}
+	return fmt.Sprintf("syscall %d", nr)
+}
+
+func seccomp(op, flags uintptr, arg unsafe.Pointer) (uintptr, syscall.Errno) {
+	nr, ok := syscallNumber("seccomp")
+	if auditArch == 0 || !ok {
+		return 0, syscall.ENOSYS
+	}
+	r, _, errno := syscall.RawSyscall(uintptr(nr), op, flags, uintptr(arg))
+	return r, errno
+}
+
+// seccompActionAvail reports whether the kernel knows the filter action.
+func seccompActionAvail(action uint32) bool {
+	_, errno := seccomp(seccompGetActionAvail, 0, unsafe.Pointer(&action))
+	return errno == 0
+}
+
+// seccompNotifyAvail reports whether a filter can hand system calls to
+// us while applying to all threads. A filter the kernel cannot read
+// fails with EFAULT, but only after it accepted the flags.
+func seccompNotifyAvail() bool {
+	_, errno := seccomp(seccompSetModeFilter, seccompFlagTsync|seccompFlagNewListener|seccompFlagTsyncEsrch, nil)
+	return errno == syscall.EFAULT && seccompActionAvail(seccompRetUserNotif)
+}
+
+// seccompProgram builds a filter that allows the system calls in allowed
+// and returns action for any other. A process of another architecture,
+// where the numbers mean something else, is killed.
+func seccompProgram(allowed []string, action uint32) []syscall.SockFilter {
+	stmt := func(code uint16, k uint32) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, K: k}
+	}
+	jump := func(k uint32, jt, jf uint8) syscall.SockFilter {
+		return syscall.SockFilter{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: jt, Jf: jf, K: k}
+	}
+	// struct seccomp_data starts with the number, then the architecture
+	prog := []syscall.SockFilter{
+		stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, 4),
+		jump(auditArch, 1, 0),
+		stmt(syscall.BPF_RET|syscall.BPF_K, seccompRetKillProcess),
+		stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, 0),
+	}
+	for _, name := range allowed {
+		if nr, ok := syscallNumber(name); ok {
+			prog = append(prog, jump(nr, 0, 1), stmt(syscall.BPF_RET|syscall.BPF_K, seccompRetAllow))
+		}
+	}
+	return append(prog, stmt(syscall.BPF_RET|syscall.BPF_K, action))
+}
+
+// filterSyscalls puts the allowlist in place on every thread. Calls
+// outside it go to the kernel's audit log or fail with EPERM, or with
+// Notify come to watchViolations to be logged by name, see Sandbox.
+// After an upgrade we carry on with the filter and listener we
+// inherited.
+func (this *Sandbox) filterSyscalls() error {
+	if fd, ok := inheritedFd(seccompFdEnv); ok {
+		seccompListener = os.NewFile(uintptr(fd), "seccomp")
+		go watchViolations(seccompListener, this.Action == SandboxDeny)
+		return nil
+	}
+	if mode, _, _ := syscall.RawSyscall(syscall.SYS_PRCTL, prGetSeccomp, 0, 0); mode == seccompModeFilter {
+		// inherited without a listener, one filter is enough
+		return nil
+	}
+	if !seccompActionAvail(seccompRetAllow) {
+		log.Printf("sandbox: seccomp is not available on this kernel, system calls are not restricted\r\n")
+		return nil
+	}
+	deny := this.Action == SandboxDeny
+	action := uint32(seccompRetLog)
+	if deny {
+		action = seccompRetErrno | uint32(syscall.EPERM)
+	}
+	flags := uintptr(seccompFlagTsync)
+	if this.Notify {
+		if seccompNotifyAvail() {
+			action, flags = seccompRetUserNotif, seccompFlagTsync|seccompFlagNewListener|seccompFlagTsyncEsrch
+		} else {
+			log.Printf("sandbox: this kernel cannot pass violations on, find them in the audit log\r\n")
+		}
+	}
+	switch action {
+	case seccompRetLog:
+		log.Printf("sandbox: system calls off the allowlist go to the audit log by number, sandbox.notify names them here\r\n")
+	case seccompRetErrno | uint32(syscall.EPERM):
+		log.Printf("sandbox: system calls off the allowlist fail with EPERM unnamed, sandbox.notify names them here\r\n")
+	}
+	filter := seccompProgram(seccompAllowed, action)
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	// seccomp wants no_new_privs on the thread that installs the filter,
+	// and passes it on to the others
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := setNoNewPrivs(); err != nil {
+		return fmt.Errorf("could not set no_new_privs: %v", err)
+	}
+	r, errno := seccomp(seccompSetModeFilter, flags, unsafe.Pointer(&prog))
+	runtime.KeepAlive(filter)
+	if errno != 0 {
+		return fmt.Errorf("could not install seccomp filter: %v", errno)
+	}
+	if flags&seccompFlagNewListener == 0 {
+		if r != 0 {
+			return fmt.Errorf("could not install seccomp filter on thread %d", r)
+		}
+		return nil
+	}
+	seccompListener = os.NewFile(r, "seccomp")
+	go watchViolations(seccompListener, deny)
+	return nil
+}
+
+// watchViolations logs the system calls the filter hands to listener,
+// and lets them through or fails them with EPERM when deny is set. A
+// call made over and over is logged the first time and then every
+// hundredth. It runs in the filtered process itself, so it makes no
+// system call off the allowlist: one would wait for it to answer.
+func watchViolations(listener *os.File, deny bool) {
+	fd := listener.Fd()
+	verdict := "allowed"
+	if deny {
+		verdict = "denied"
+	}
+	counts := map[int32]int{}
+	for {
+		var req seccompNotif
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, seccompIoctlNotifRecv, uintptr(unsafe.Pointer(&req)))
+		if errno == syscall.EINTR || errno == syscall.ENOENT {
+			// interrupted, or the caller went away before we got to it
+			continue
+		}
+		if errno != 0 {
+			log.Printf("sandbox: stopped watching for violations: %v\r\n", errno)
+			return
+		}
+		resp := seccompNotifResp{Id: req.Id, Flags: seccompUserNotifFlagContinue}
+		if deny {
+			resp.Error, resp.Flags = -int32(syscall.EPERM), 0
+		}
+		syscall.Syscall(syscall.SYS_IOCTL, fd, seccompIoctlNotifSend, uintptr(unsafe.Pointer(&resp)))
+
+		counts[req.Nr]++
+		if n := counts[req.Nr]; n == 1 || n%100 == 0 {
+			log.Printf("sandbox: thread %d called %s, which is not on the allowlist; %s (%d times)\r\n",
+				req.Pid, syscallName(req.Nr), verdict, n)
+		}
+	}
+}
+
+// landlockABI returns the Landlock version the kernel supports.
+func landlockABI() (int, error) {
+	nr, ok := syscallNumber("landlock_create_ruleset")
+	if !ok {
+		return 0, syscall.ENOSYS
+	}
+	abi, _, errno := syscall.RawSyscall(uintptr(nr), 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		if errno == syscall.EOPNOTSUPP {
+			return 0, fmt.Errorf("disabled at boot")
+		}
+		return 0, errno
+	}
+	return int(abi), nil
+}
+
+// restrictThread confines the calling thread, and what it starts, to
+// the files in Read, the directories in Write and the system paths the
+// binary needs. It reports false when the kernel has no Landlock.
+func (this *Sandbox) restrictThread() (bool, error) {
+	abi, err := landlockABI()
+	if err != nil {
+		log.Printf("sandbox: Landlock is not available (%v), file access is not restricted\r\n", err)
+		return false, nil
+	}
+	handled := uint64(landlockAllV1)
+	if abi >= 3 {
+		handled |= landlockTruncate
+	}
+	create, _ := syscallNumber("landlock_create_ruleset")
+	addRule, _ := syscallNumber("landlock_add_rule")
+	restrictSelf, _ := syscallNumber("landlock_restrict_self")
+
+	attr := handled
+	fd, _, errno := syscall.RawSyscall(uintptr(create), uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return false, fmt.Errorf("landlock_create_ruleset: %v", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	allow := func(path string, access uint64) error {
+		f, err := os.OpenFile(path, oPath|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if fi, err := f.Stat(); err == nil && !fi.IsDir() {
+			access &= landlockFileRights
+		}
+		rule := landlockPathBeneath{AllowedAccess: access & handled, ParentFd: int32(f.Fd())}
+		_, _, errno := syscall.RawSyscall6(uintptr(addRule), fd, landlockRulePathBeneath,
+			uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+		if errno != 0 {
+			return fmt.Errorf("landlock_add_rule %s: %v", path, errno)
+		}
+		return nil
+	}
+	for path, access := range landlockSystemPaths {
+		if err := allow(path, access); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	// a directory, the binary is replaced on upgrade
+	if exe, err := os.Executable(); err == nil {
+		if err := allow(filepath.Dir(exe), landlockExec); err != nil {
+			return false, err
+		}
+	}
+	for _, path := range this.Read {
+		if err := allow(path, landlockRead); err != nil {
+			return false, err
+		}
+	}
+	for _, path := range this.Write {
+		if err := allow(path, handled); err != nil {
+			if !os.IsNotExist(err) {
+				return false, err
+			}
+			log.Printf("sandbox: %s does not exist, the daemon cannot write there\r\n", path)
+		}
+	}
+
+	if err := setNoNewPrivs(); err != nil {
+		return false, fmt.Errorf("could not set no_new_privs: %v", err)
+	}
+	if _, _, errno := syscall.RawSyscall(uintptr(restrictSelf), fd, 0, 0); errno != 0 {
+		return false, fmt.Errorf("landlock_restrict_self: %v", errno)
+	}
+	return true, nil
+}
+
+// KernelFeatures reports what the kernel offers the sandbox.
+func KernelFeatures() []Feature {
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prGetNoNewPrivs, 0, 0)
+	features := []Feature{{
+		Name:      "no_new_privs",
+		Available: errno == 0,
+		Detail:    "needed by both seccomp and Landlock without CAP_SYS_ADMIN",
+	}}
+
+	seccompFeature := Feature{Name: "seccomp", Available: seccompActionAvail(seccompRetAllow)}
+	switch {
+	case auditArch == 0:
+		seccompFeature.Detail = "no system call table for " + runtime.GOARCH
+	case !seccompFeature.Available:
+		seccompFeature.Detail = "system calls are not restricted"
+	case seccompNotifyAvail():
+		seccompFeature.Detail = "violations go to the kernel's audit log, or by name to ours with sandbox.notify"
+	case seccompActionAvail(seccompRetLog):
+		seccompFeature.Detail = "violations go to the kernel's audit log, sandbox.notify needs Linux 5.7"
+	default:
+		seccompFeature.Detail = "violations are not logged, the log action needs Linux 4.14"
+	}
+	features = append(features, seccompFeature)
+
+	landlock := Feature{Name: "landlock"}
+	if abi, err := landlockABI(); err != nil {
+		landlock.Detail = fmt.Sprintf("file access is not restricted: %v", err)
+	} else {
+		landlock.Available, landlock.Detail = true, fmt.Sprintf("ABI version %d", abi)
+	}
+	return append(features, landlock)
+}
@@ -0,0 +1,135 @@
+package servicelib
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// tableNames returns the names in the syscallNames table in file.
+func tableNames(t *testing.T, file string) map[string]bool {
+	f, err := parser.ParseFile(token.NewFileSet(), file, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	ast.Inspect(f, func(n ast.Node) bool {
+		spec, ok := n.(*ast.ValueSpec)
+		if !ok || len(spec.Names) != 1 || spec.Names[0].Name != "syscallNames" {
+			return true
+		}
+		ast.Inspect(spec, func(n ast.Node) bool {
+			if kv, ok := n.(*ast.KeyValueExpr); ok {
+				if lit, ok := kv.Value.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+					name, _ := strconv.Unquote(lit.Value)
+					names[name] = true
+				}
+			}
+			return true
+		})
+		return false
+	})
+	if len(names) == 0 {
+		t.Fatalf("no syscallNames in %s", file)
+	}
+	return names
+}
+
+// TestSeccompAllowedKnown checks every name on the allowlist is in one
+// of the tables at least; the filter skips those it cannot look up, so
+// a typo would leave the call out without a word.
+func TestSeccompAllowedKnown(t *testing.T) {
+	amd64 := tableNames(t, "syscalls_linux_amd64.go")
+	arm64 := tableNames(t, "syscalls_linux_arm64.go")
+	for _, name := range seccompAllowed {
+		if !amd64[name] && !arm64[name] {
+			t.Errorf("%s is on the allowlist but neither amd64 nor arm64 has it", name)
+		}
+	}
+	for _, name := range []string{"seccomp", "landlock_create_ruleset", "landlock_add_rule", "landlock_restrict_self"} {
+		if !amd64[name] || !arm64[name] {
+			t.Errorf("%s is missing from a table, the sandbox looks it up", name)
+		}
+	}
+}
+
+// seccompChildEnv has the test binary filter itself as the action it
+// names, with ",notify" for Notify, and make a system call off the
+// allowlist.
+const seccompChildEnv = "OLESERVICE_TEST_SECCOMP"
+
+// seccompChild reports on stdout how getpgid, which the allowlist
+// lacks, fares under the filter.
+func seccompChild(mode string) {
+	action, notify := mode, false
+	if i := strings.Index(mode, ","); i >= 0 {
+		action, notify = mode[:i], mode[i+1:] == "notify"
+	}
+	sandbox := &Sandbox{Seccomp: true, Action: action, Notify: notify}
+	if err := sandbox.filterSyscalls(); err != nil {
+		fmt.Printf("filter: %v\n", err)
+		os.Exit(1)
+	}
+	// not syscall.Getpgid: a raw system call keeps its P, and with
+	// GOMAXPROCS=1 the watcher would wait for it
+	nr, _ := syscallNumber("getpgid")
+	if _, _, errno := syscall.Syscall(uintptr(nr), 0, 0, 0); errno != 0 {
+		fmt.Printf("getpgid: %v\n", errno)
+	} else {
+		fmt.Printf("getpgid: ok\n")
+	}
+	os.Exit(0)
+}
+
+func TestSeccompAction(t *testing.T) {
+	if mode := os.Getenv(seccompChildEnv); mode != "" {
+		seccompChild(mode)
+		return
+	}
+	if auditArch == 0 || !seccompActionAvail(seccompRetAllow) {
+		t.Skip("no seccomp here")
+	}
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{"log", "getpgid: ok"},
+		{"deny", "getpgid: operation not permitted"},
+		{"log,notify", "getpgid: ok"},
+		{"deny,notify", "getpgid: operation not permitted"},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			if strings.HasSuffix(test.mode, ",notify") && !seccompNotifyAvail() {
+				t.Skip("this kernel cannot pass violations on")
+			}
+			// a filter that waits on itself hangs rather than fails
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestSeccompAction$")
+			cmd.Env = append(os.Environ(), seccompChildEnv+"="+test.mode)
+			out, err := cmd.CombinedOutput()
+			if ctx.Err() != nil {
+				t.Fatalf("hung under the filter:\n%s", out)
+			}
+			if err != nil {
+				t.Fatalf("%v:\n%s", err, out)
+			}
+			if !strings.Contains(string(out), test.want+"\n") {
+				t.Errorf("got\n%s\nwant %q", out, test.want)
+			}
+			if strings.HasSuffix(test.mode, ",notify") && !strings.Contains(string(out), "called getpgid") {
+				t.Logf("not logged before the child exited:\n%s", out)
+			}
+		})
+	}
+}
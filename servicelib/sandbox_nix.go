@@ -0,0 +1,77 @@
+// +build linux darwin
+
+package servicelib
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"time"
+)
+
+// sandboxedEnv marks a daemon Landlock confines already, so it does not
+// start yet another copy of itself. Upgrades pass it on: the new process
+// inherits the Landlock domain along with it.
+const sandboxedEnv = "OLESERVICE_SANDBOXED"
+
+// What a system call outside the seccomp allowlist gets.
+const (
+	// SandboxLog lets it through.
+	SandboxLog = "log"
+	// SandboxDeny fails it with EPERM.
+	SandboxDeny = "deny"
+)
+
+// Sandbox is what the daemon confines itself to once its listeners are
+// bound and its log file is open.
+type Sandbox struct {
+	// Seccomp limits the system calls to what a network daemon needs.
+	// Action, SandboxLog or SandboxDeny, is what happens to the others:
+	// the kernel lets them through and audits them by number, or fails
+	// them with EPERM, audited only where auditd runs. Neither names
+	// them in our log.
+	Seccomp bool
+	Action  string
+	// Notify has the kernel hand those calls to the daemon to log by
+	// name first. The caller waits on a goroutine of the daemon, so it
+	// can hang the daemon; use it to find what the allowlist misses.
+	Notify bool
+	// Landlock limits file access to reading the files and directories
+	// in Read and writing in the directories in Write, besides what the
+	// binary needs to run at all.
+	Landlock bool
+	Read     []string
+	Write    []string
+}
+
+// Apply confines the daemon. Landlock, like no_new_privs, applies to
+// the thread that asks for it and what that thread starts, and a Go
+// program has many threads. So Apply starts a copy of the daemon from
+// a restricted thread and hands it the listeners and pid file like
+// Upgrade does, then returns the copy's pid once it serves; the caller
+// is done then. The copy, or a daemon that needs no copy, gets 0 with
+// the seccomp filter in place on all its threads.
+//
+// A daemon an upgrade started inherits both from the old one, whatever
+// its config says now; only Action takes effect.
+//
+// What the kernel does not support is skipped with a warning in the
+// log, see KernelFeatures.
+func (this *Sandbox) Apply(listeners []net.Listener, pidfile *PidFile, timeout time.Duration) (int, error) {
+	if this.Landlock && os.Getenv(sandboxedEnv) == "" {
+		// the thread stays restricted, keep this goroutine on it
+		runtime.LockOSThread()
+		restricted, err := this.restrictThread()
+		if err != nil {
+			return 0, err
+		}
+		if restricted {
+			return handOver(listeners, pidfile, timeout, nil, sandboxedEnv+"=1")
+		}
+		runtime.UnlockOSThread()
+	}
+	if this.Seccomp || os.Getenv(seccompFdEnv) != "" {
+		return 0, this.filterSyscalls()
+	}
+	return 0, nil
+}
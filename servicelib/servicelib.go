@@ -4,21 +4,67 @@ import (
 	"fmt"
 	// "github.com/oliveagle/ole_tryout_daemon/config"
 	// "github.com/spf13/viper"
-	"github.com/takama/daemon"
 	"os"
 	"path/filepath"
 )
 
+// IServiceManager is an init system backend. It registers the service
+// with one init system and has that init system start and stop it.
 type IServiceManager interface {
-	InstallService(name string, desc string) error
-	RemoveService(name string) error
-	StartService(name string) error
-	StopService(name string) error
-	PauseService(name string) error
-	ContinueService(name string) error
+	// Name is what --backend= selects the backend by.
+	Name() string
+	// Detect reports whether this init system manages the machine.
+	Detect() bool
 
-	// RunService(name string, isDebug bool)
-	Status(name string) string
+	// Files lists what installing puts on the system for this init
+	// system, and Commands what registers it there.
+	Files() ([]InstallFile, error)
+	Commands() Commands
+	Installed() bool
+
+	Start() error
+	Stop() error
+	// MainPid returns the pid the init system runs the service as, when
+	// it considers the service active.
+	MainPid() (int, bool)
+}
+
+// InstallFile is a file a backend installs.
+type InstallFile struct {
+	// Path is where the file goes on the real system.
+	Path string
+	// Mode carries os.ModeDir for a directory and os.ModeSymlink for a
+	// link to Link; anything else is a regular file holding Data.
+	Mode os.FileMode
+	Data []byte
+	Link string
+	// Source is a file to copy instead of writing Data.
+	Source string
+	// NoReplace leaves a file that is already there alone.
+	NoReplace bool
+	// Purge has remove --purge delete a directory with everything in it.
+	Purge bool
+}
+
+// Commands are the init system commands that go with installed files.
+// They name paths on the real system, also when the files are staged
+// below another root.
+type Commands struct {
+	// Install runs once the files are in place.
+	Install [][]string `json:"install,omitempty"`
+	// Remove runs before the files are deleted, Cleanup after.
+	Remove  [][]string `json:"remove,omitempty"`
+	Cleanup [][]string `json:"cleanup,omitempty"`
+	// Purge runs last on remove --purge.
+	Purge [][]string `json:"purge,omitempty"`
+}
+
+// Feature is a kernel feature the sandbox uses, as doctor reports it.
+type Feature struct {
+	Name      string
+	Available bool
+	// Detail says what it means for the sandbox.
+	Detail string
 }
 
 // type ServiceManager struct{}
@@ -50,19 +96,35 @@ func exePath() (string, error) {
 }
 
 type Service struct {
-	daemon.Daemon
-	name string
-	desc string
+	name    string
+	desc    string
+	program Program
 	// config config.Config
-}
 
-func NewService(name, desc string) *Service {
-	srv, err := daemon.New(name, desc)
-	if err != nil {
-		fmt.Println("Error: ", err)
-		os.Exit(1)
-	}
+	// Version is reported by Status when the daemon has not published
+	// its own.
+	Version string
+	// Backend names the init system backend to use, detected when empty.
+	Backend string
+	// Linger has install enable lingering for a user's systemd unit.
+	Linger bool
+	// Root stages install and remove below another directory, e.g. to
+	// build a package; no init system commands are run then.
+	Root string
+	// DryRun has install and remove print their manifest instead of
+	// changing anything.
+	DryRun bool
+	// Purge has remove delete the config, logs, state and the account
+	// install created as well.
+	Purge bool
+	// Detach has start run the daemon in the background itself instead
+	// of through the init system.
+	Detach bool
+}
 
+// NewService returns the service called name, which runs program. The
+// commands that only manage the service need no program, nil will do.
+func NewService(name, desc string, program Program) *Service {
 	// config.SetDefault()
 	// conf, err := config.NewConfig(name)
 	// if err != nil {
@@ -71,5 +133,10 @@ func NewService(name, desc string) *Service {
 	// }
 
 	// return &Service{srv, name, desc, *conf}
-	return &Service{srv, name, desc}
+	return &Service{name: name, desc: desc, program: program}
+}
+
+// Program returns the work the service does.
+func (this *Service) Program() Program {
+	return this.program
 }
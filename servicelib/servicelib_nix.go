@@ -3,57 +3,442 @@
 package servicelib
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/spf13/viper"
 	"log"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// PauseSignal asks the running daemon to stop accepting connections.
+	PauseSignal = syscall.SIGUSR1
+	// ContinueSignal asks a paused daemon to accept connections again.
+	ContinueSignal = syscall.SIGUSR2
+	// ReloadSignal asks the running daemon to re-read its config.
+	ReloadSignal = syscall.SIGHUP
+	// UpgradeSignal asks the running daemon to hand over to a new copy
+	// of its binary. SIGUSR1 and SIGUSR2 are taken by pause and
+	// continue; the daemon never reads from a terminal, which leaves
+	// SIGTTIN free.
+	UpgradeSignal = syscall.SIGTTIN
 )
 
 func (this *Service) IsAnInteractiveSession() (bool, error) {
-	log.Println("IsAnInteractiveSessioin\r\n")
+	log.Print("IsAnInteractiveSessioin\r\n")
 	// log.Printf("Getegid: %s  \r\n", os.Getegid())
-	return false, nil
+
+	// systemd sets these for every service it starts
+	if os.Getenv("INVOCATION_ID") != "" || os.Getenv("NOTIFY_SOCKET") != "" {
+		return false, nil
+	}
+	// started by init or launchd, or reparented to it after a double fork
+	if os.Getppid() == 1 {
+		return false, nil
+	}
+	return isTerminal(os.Stdin) || isTerminal(os.Stdout), nil
+}
+
+// isTerminal reports whether f is connected to a terminal.
+func isTerminal(f *os.File) bool {
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), ioctlReadTermios, uintptr(unsafe.Pointer(&termios)))
+	return errno == 0
 }
 
+// InstallService puts the service's files in place and registers it
+// with the init system, then leaves a manifest of what it did for
+// RemoveService. Staged below Root it only writes the files and the
+// manifest; with DryRun it prints the manifest and changes nothing.
 func (this *Service) InstallService() error {
-	log.Println("ServiceManager.InstallService\r\n")
-	str, err := this.Install()
-	log.Println("InstallService: %s, err: %s", str, err)
-	return err
+	log.Print("ServiceManager.InstallService\r\n")
+	host := this.host()
+	backend, err := SelectBackend(host, this.Backend)
+	if err != nil {
+		return err
+	}
+	if viper.GetBool("daemon.socket_activation") && !strings.HasPrefix(backend.Name(), "systemd") {
+		return fmt.Errorf("socket activation needs systemd, not %s", backend.Name())
+	}
+	// the user's service manager is anyone's to install into
+	user := backend.Name() == "systemd-user"
+	if !this.DryRun {
+		if !user {
+			if err := host.checkPrivileges("install"); err != nil {
+				return err
+			}
+		}
+		if backend.Installed() {
+			return fmt.Errorf("%s is already installed for %s", this.name, backend.Name())
+		}
+	}
+
+	files, cmds, err := this.installPlan(host, backend, user)
+	if err != nil {
+		return err
+	}
+	m, err := newManifest(host, backend, files, cmds)
+	if err != nil {
+		return err
+	}
+	if this.DryRun {
+		return m.Write(os.Stdout)
+	}
+
+	log.Printf("InstallService: installing for %s below %s\r\n", backend.Name(), host.Root)
+	if err := host.writeFiles(files); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	m.Write(&buf)
+	err = host.writeFiles([]InstallFile{{Path: manifestPath(this.name, user), Mode: 0644, Data: buf.Bytes()}})
+	if err != nil {
+		return err
+	}
+	if host.staged() {
+		fmt.Printf("%s staged below %s, see %s for the commands that enable it\n",
+			this.name, host.Root, host.Path(manifestPath(this.name, user)))
+		return nil
+	}
+	if err := host.runCommands(m.Commands.Install, false); err != nil {
+		return err
+	}
+	switch backend.Name() {
+	case "nohup":
+		fmt.Printf("no init system found; run %s start to start %s\n", host.Exe, this.name)
+	case "systemd-user":
+		return this.linger()
+	}
+	return nil
 }
 
-func (this *Service) RemoveService() error {
-	log.Println("ServiceManager.RemoveService\r\n")
-	str, err := this.Remove()
-	log.Println("RemoveService: %s, err: %s", str, err)
-	return err
+// linger keeps the user's service manager, and with it the daemon,
+// running when the user is not logged in. Unless asked to enable it we
+// only point out how.
+func (this *Service) linger() error {
+	u, err := user.Current()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat("/var/lib/systemd/linger/" + u.Username); err == nil {
+		return nil
+	}
+	if !this.Linger {
+		fmt.Printf("%s only runs while %s is logged in; to keep it running, enable lingering with\n"+
+			"  loginctl enable-linger %s\n"+
+			"or install with --linger\n", this.name, u.Username, u.Username)
+		return nil
+	}
+	if out, err := exec.Command("loginctl", "enable-linger", u.Username).CombinedOutput(); err != nil {
+		return fmt.Errorf("could not enable lingering for %s: %v: %s", u.Username, err, strings.TrimSpace(string(out)))
+	}
+	return nil
 }
 
-func (this *Service) Status() error {
-	log.Println("ServiceManagement.Status not supported\r\n")
+// RemoveService undoes what the manifest says install did. Config, logs
+// and state stay, along with the account, unless Purge is set. For a
+// service installed before there were manifests, it removes what the
+// backend would install now.
+func (this *Service) RemoveService() error {
+	log.Print("ServiceManager.RemoveService\r\n")
+	host := this.host()
+	backend, err := SelectBackend(host, this.Backend)
+	if err != nil {
+		return err
+	}
+	user := backend.Name() == "systemd-user"
+	path := manifestPath(this.name, user)
+	m, err := readManifest(host.Path(path))
+	if os.IsNotExist(err) {
+		if !backend.Installed() {
+			return fmt.Errorf("%s is not installed", this.name)
+		}
+		if m, err = installedManifest(host, backend); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if this.DryRun {
+		return m.Write(os.Stdout)
+	}
+	if !user {
+		if err := host.checkPrivileges("remove"); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("RemoveService: removing from %s below %s\r\n", m.Backend, host.Root)
+	if !host.staged() {
+		host.runCommands(m.Commands.Remove, true)
+	}
+	os.Remove(host.Path(path))
+	host.removeFiles(m.Files, this.Purge)
+	if !host.staged() {
+		host.runCommands(m.Commands.Cleanup, true)
+		if this.Purge {
+			host.runCommands(m.Commands.Purge, true)
+		}
+	}
 	return nil
 }
 
-func (this *Service) StartService() error {
-	log.Println("ServiceManager.StartService\r\n")
+// installedManifest lists the backend's files, all of them, as there is
+// no telling which of the directories install made.
+func installedManifest(host *Host, backend IServiceManager) (*Manifest, error) {
+	files, err := backend.Files()
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{Name: host.Name, Backend: backend.Name(), Root: host.Root, Commands: backend.Commands()}
+	for _, f := range files {
+		entry, err := manifestFile(f)
+		if err != nil {
+			return nil, err
+		}
+		// what we would write today may not be what was written then
+		entry.SHA256 = ""
+		m.Files = append(m.Files, entry)
+	}
+	return m, nil
+}
+
+func (this *Service) Status() (*ServiceStatus, error) {
+	log.Print("ServiceManagement.Status\r\n")
+	backend, err := this.backend()
+	if err != nil {
+		return nil, err
+	}
+	st := &ServiceStatus{
+		Name:      this.name,
+		Backend:   backend.Name(),
+		Installed: backend.Installed(),
+		Version:   this.Version,
+	}
+
+	pidfile := PidFilePath(this.name)
+	pid, locked, err := ReadPidFile(pidfile)
+	switch {
+	case err == nil && locked && processAlive(pid):
+		st.State = StateRunning
+		st.Pid = pid
+		// the daemon knows best, its state file is what it last wrote
+		if resp, err := this.control(&ControlRequest{Command: ControlStatus}, 5*time.Second); err == nil &&
+			resp.State != nil && resp.State.Pid == pid {
+			st.applyDaemonState(resp.State)
+		} else if state, err := ReadStateFile(StateFilePath(this.name)); err == nil && state.Pid == pid {
+			st.applyDaemonState(state)
+		}
+	case err == nil:
+		st.State = StateDead
+		st.Detail = fmt.Sprintf("pid file %s left behind by pid %d", pidfile, pid)
+	case os.IsNotExist(err):
+		st.State = StateStopped
+		if pid, ok := backend.MainPid(); ok {
+			st.State = StateRunning
+			st.Pid = pid
+			st.Detail = "reported by the init system, no pid file"
+		} else if state, err := ReadStateFile(StateFilePath(this.name)); err == nil && state.Shutdown != nil &&
+			state.Shutdown.Error != "" {
+			st.Detail = fmt.Sprintf("pid %d failed: %s", state.Pid, state.Shutdown.Error)
+			// how its child last exited, when it ran one
+			st.Child = state.Child
+		}
+	default:
+		st.State = StateUnknown
+		st.Detail = err.Error()
+	}
+	return st, nil
+}
 
-	str, err := this.Start()
-	log.Println("StartService: %s, err: %s", str, err)
-	return err
+func (this *Service) StartService() error {
+	log.Print("ServiceManager.StartService\r\n")
+	if this.Detach {
+		pid, err := this.host().detach()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s started as pid %d\n", this.name, pid)
+		return nil
+	}
+	backend, err := this.backend()
+	if err != nil {
+		return err
+	}
+	return backend.Start()
 }
 
 func (this *Service) StopService() error {
-	log.Println("ServiceManager.StopService\r\n")
-	str, err := this.Stop()
-	log.Println("StopService: %s, err: %s", str, err)
-	return err
+	log.Print("ServiceManager.StopService\r\n")
+	backend, err := this.backend()
+	if err != nil {
+		return err
+	}
+	pid, err := this.runningPid()
+	if err != nil {
+		// no pid file, the init system may still know better
+		return backend.Stop()
+	}
+
+	if initPid, ok := backend.MainPid(); ok && initPid == pid {
+		// stop through the init system so it does not restart us
+		if err := backend.Stop(); err != nil {
+			return err
+		}
+	} else if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return fmt.Errorf("could not signal %s (pid %d): %v", this.name, pid, err)
+	}
+
+	// the daemon may spend up to its drain timeout on open connections
+	timeout := viper.GetDuration("daemon.drain_timeout") + 10*time.Second
+	if err := waitExit(PidFilePath(this.name), pid, timeout); err != nil {
+		return err
+	}
+
+	state, err := ReadStateFile(StateFilePath(this.name))
+	if err == nil && state.Pid == pid && state.Shutdown != nil {
+		fmt.Printf("%s stopped: %d connections drained, %d killed\n",
+			this.name, state.Shutdown.Drained, state.Shutdown.Killed)
+	} else {
+		fmt.Printf("%s stopped\n", this.name)
+	}
+	return nil
 }
 
+// waitExit waits for pid to release the pid file at path.
+func waitExit(path string, pid int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		current, locked, err := ReadPidFile(path)
+		if os.IsNotExist(err) || (err == nil && (!locked || current != pid)) || !processAlive(pid) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for pid %d to exit", pid)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// PauseService and the other commands the daemon answers on its control
+// socket go there first, and fall back to a signal when it does not.
 func (this *Service) PauseService() error {
-	log.Println("ServiceManager.PauseServicen not supported \r\n")
+	log.Print("ServiceManager.PauseService\r\n")
+	_, err := this.control(&ControlRequest{Command: ControlPause}, 10*time.Second)
+	if err == errNoControl {
+		return this.signalDaemon(PauseSignal)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s paused\n", this.name)
 	return nil
 }
 
 func (this *Service) ContinueService() error {
-	log.Println("ServiceManager.ContinueService not supported \r\n")
+	log.Print("ServiceManager.ContinueService\r\n")
+	_, err := this.control(&ControlRequest{Command: ControlContinue}, 10*time.Second)
+	if err == errNoControl {
+		return this.signalDaemon(ContinueSignal)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s continued\n", this.name)
+	return nil
+}
+
+func (this *Service) ReloadService() error {
+	log.Print("ServiceManager.ReloadService\r\n")
+	resp, err := this.control(&ControlRequest{Command: ControlReload}, 10*time.Second)
+	if err != errNoControl {
+		if err != nil {
+			return err
+		}
+		return printReload(this.name, resp.Reload)
+	}
+
+	pid, err := this.runningPid()
+	if err != nil {
+		return err
+	}
+	sent := time.Now()
+	if err := syscall.Kill(pid, ReloadSignal); err != nil {
+		return fmt.Errorf("could not signal %s (pid %d): %v", this.name, pid, err)
+	}
+
+	// the daemon answers through its state file
+	path := StateFilePath(this.name)
+	timeout := time.Now().Add(10 * time.Second)
+	for {
+		state, err := ReadStateFile(path)
+		if err == nil && state.Pid == pid && state.Reload != nil && !state.Reload.Time.Before(sent) {
+			return printReload(this.name, state.Reload)
+		}
+		if timeout.Before(time.Now()) {
+			return fmt.Errorf("timeout waiting for %s (pid %d) to reload", this.name, pid)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (this *Service) UpgradeService() error {
+	log.Print("ServiceManager.UpgradeService\r\n")
+	pid, err := this.runningPid()
+	if err != nil {
+		return err
+	}
+	if backend, err := this.backend(); err == nil {
+		// runit and s6 only watch the process they started, they would
+		// start a second daemon once the first one hands over and exits
+		if mainPid, ok := backend.MainPid(); ok && mainPid == pid &&
+			(backend.Name() == "runit" || backend.Name() == "s6") {
+			return fmt.Errorf("upgrade is not supported under %s, restart %s instead", backend.Name(), this.name)
+		}
+	}
+	sent := time.Now()
+	if err := syscall.Kill(pid, UpgradeSignal); err != nil {
+		return fmt.Errorf("could not signal %s (pid %d): %v", this.name, pid, err)
+	}
+
+	// the new process takes over the state file once it is ready, the
+	// old one records there why it could not hand over
+	path := StateFilePath(this.name)
+	timeout := time.Now().Add(viper.GetDuration("daemon.upgrade_timeout") + 10*time.Second)
+	for {
+		state, err := ReadStateFile(path)
+		if err == nil && state.Pid != pid && state.State == StateRunning && !state.Started.Before(sent) {
+			fmt.Printf("%s upgraded: pid %d -> %d, version %s\n", this.name, pid, state.Pid, state.Version)
+			return nil
+		}
+		if err == nil && state.Pid == pid && state.Upgrade != nil && !state.Upgrade.Time.Before(sent) {
+			return fmt.Errorf("upgrade failed, pid %d keeps serving: %s", pid, state.Upgrade.Error)
+		}
+		if timeout.Before(time.Now()) {
+			return fmt.Errorf("timeout waiting for %s (pid %d) to upgrade", this.name, pid)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func printReload(name string, report *ReloadReport) error {
+	if report.Error != "" {
+		return fmt.Errorf("new config rejected, still running the old one: %s", report.Error)
+	}
+	if len(report.Applied) == 0 && len(report.Restart) == 0 {
+		fmt.Printf("%s reloaded, no settings changed\n", name)
+	} else if len(report.Applied) > 0 {
+		fmt.Printf("%s reloaded, applied: %s\n", name, strings.Join(report.Applied, ", "))
+	}
+	if len(report.Restart) > 0 {
+		fmt.Printf("%s needs a restart to apply: %s\n", name, strings.Join(report.Restart, ", "))
+	}
 	return nil
 }
 
@@ -7,6 +7,7 @@ import (
 	"code.google.com/p/winsvc/mgr"
 	"code.google.com/p/winsvc/svc"
 	"fmt"
+	"io"
 	"log"
 	"time"
 )
@@ -17,6 +18,9 @@ func (this *Service) IsAnInteractiveSession() (bool, error) {
 
 func (this *Service) StartService() error {
 	log.Println("ServiceManager.StartService\r\n")
+	if this.Detach {
+		return fmt.Errorf("--detach is not supported on windows, start the service instead")
+	}
 	m, err := mgr.Connect()
 	if err != nil {
 		return err
@@ -42,6 +46,9 @@ func (this *Service) StartService() error {
 
 func (this *Service) InstallService() error {
 	log.Println("ServiceManager.InstallService\r\n")
+	if this.Root != "" || this.DryRun {
+		return fmt.Errorf("--root and --dry-run are not supported on windows")
+	}
 	exepath, err := exePath()
 	if err != nil {
 		return err
@@ -71,6 +78,9 @@ func (this *Service) InstallService() error {
 
 func (this *Service) RemoveService() error {
 	log.Println("ServiceManager.RemoveService\r\n")
+	if this.Root != "" || this.DryRun || this.Purge {
+		return fmt.Errorf("--root, --dry-run and --purge are not supported on windows")
+	}
 	m, err := mgr.Connect()
 	if err != nil {
 		return err
@@ -92,9 +102,38 @@ func (this *Service) RemoveService() error {
 	return nil
 }
 
-func (this *Service) Status() error {
+func (this *Service) Status() (*ServiceStatus, error) {
 	log.Println("ServiceManagement.Status\r\n")
-	return nil
+	st := &ServiceStatus{Name: this.name, Version: this.Version}
+	m, err := mgr.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(this.name)
+	if err != nil {
+		st.State = StateStopped
+		return st, nil
+	}
+	defer s.Close()
+	st.Installed = true
+
+	status, err := s.Query()
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve service status: %v", err)
+	}
+	switch status.State {
+	case svc.Running:
+		st.State = StateRunning
+	case svc.Paused:
+		st.State = StatePaused
+	case svc.Stopped:
+		st.State = StateStopped
+	default:
+		st.State = StateUnknown
+		st.Detail = fmt.Sprintf("service is in state=%d", status.State)
+	}
+	return st, nil
 }
 
 func (this *Service) StopService() error {
@@ -112,7 +151,60 @@ func (this *Service) ContinueService() error {
 	return controlService(this.name, svc.Continue, svc.Running)
 }
 
-func controlService(name string, c svc.Cmd, to svc.State) error {
+// ReloadCmd is the control reload sends the service. This winsvc has no
+// ParamChange, so it is a user-defined control, which the service
+// control manager passes on without the service accepting it first.
+const ReloadCmd = svc.Cmd(128)
+
+// ReloadService has the running or paused service re-read its config,
+// see ReloadCmd. The service stays in the state it was in.
+func (this *Service) ReloadService() error {
+	log.Println("ServiceManager.ReloadService\r\n")
+	return controlService(this.name, ReloadCmd, svc.Running, svc.Paused)
+}
+
+func (this *Service) UpgradeService() error {
+	log.Println("ServiceManager.UpgradeService\r\n")
+	return fmt.Errorf("upgrade is not supported on windows, restart %s instead", this.name)
+}
+
+// DrainService and the other commands that need the control socket fail
+// on windows, where the daemon has none.
+func (this *Service) DrainService(timeout time.Duration) error {
+	return fmt.Errorf("drain is not supported on windows")
+}
+
+func (this *Service) ListConnections(w io.Writer, asJSON bool) error {
+	return fmt.Errorf("connections is not supported on windows")
+}
+
+func (this *Service) ChangeLogLevel(level string) error {
+	return fmt.Errorf("log-level is not supported on windows")
+}
+
+func (this *Service) DumpGoroutines(w io.Writer) error {
+	return fmt.Errorf("dump is not supported on windows")
+}
+
+// PrintServiceUnit fails on windows, where install registers the service
+// with the service control manager instead of writing a unit.
+func (this *Service) PrintServiceUnit(w io.Writer) error {
+	return fmt.Errorf("install --print is not supported on windows")
+}
+
+// NotifyParent does nothing on windows, where no process waits on
+// another one to take over.
+func NotifyParent(startErr error) {}
+
+// KernelFeatures has nothing to report on windows, the sandbox is Linux
+// only.
+func KernelFeatures() []Feature {
+	return nil
+}
+
+// controlService sends c to the service and waits for it to reach one
+// of the states in to.
+func controlService(name string, c svc.Cmd, to ...svc.State) error {
 	log.Printf("controlService: %s \r\n", name)
 	m, err := mgr.Connect()
 	if err != nil {
@@ -129,9 +221,9 @@ func controlService(name string, c svc.Cmd, to svc.State) error {
 		return fmt.Errorf("could not send control=%d: %v", c, err)
 	}
 	timeout := time.Now().Add(10 * time.Second)
-	for status.State != to {
+	for !hasState(to, status.State) {
 		if timeout.Before(time.Now()) {
-			return fmt.Errorf("timeout waiting for service to go to state=%d", to)
+			return fmt.Errorf("timeout waiting for service to go to state=%v", to)
 		}
 		time.Sleep(300 * time.Millisecond)
 		status, err = s.Query()
@@ -141,3 +233,12 @@ func controlService(name string, c svc.Cmd, to svc.State) error {
 	}
 	return nil
 }
+
+func hasState(states []svc.State, state svc.State) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,333 @@
+package servicelib
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Exit codes for the status command, as defined by the LSB init script
+// specification.
+const (
+	LSBRunning     = 0
+	LSBDeadPidFile = 1
+	LSBNotRunning  = 3
+	LSBUnknown     = 4
+)
+
+// Service states reported by Status.
+const (
+	StateRunning = "running"
+	StatePaused  = "paused"
+	StateStopped = "stopped"
+	StateDead    = "dead"
+	StateUnknown = "unknown"
+)
+
+// StateFilePath returns the file the daemon publishes its DaemonState
+// in, taken from daemon.statefile in the config.
+func StateFilePath(name string) string {
+	if path := viper.GetString("daemon.statefile"); path != "" {
+		return path
+	}
+	return "/var/run/" + name + ".state"
+}
+
+// DaemonState is what the running daemon publishes about itself in its
+// state file, for the status command to pick up.
+type DaemonState struct {
+	Pid      int             `json:"pid"`
+	State    string          `json:"state"`
+	Started  time.Time       `json:"started"`
+	Listen   []string        `json:"listen"`
+	Version  string          `json:"version"`
+	Shutdown *ShutdownReport `json:"shutdown,omitempty"`
+	Reload   *ReloadReport   `json:"reload,omitempty"`
+	Upgrade  *UpgradeReport  `json:"upgrade,omitempty"`
+	Identity *Identity       `json:"identity,omitempty"`
+	Process  *ProcessInfo    `json:"process,omitempty"`
+	// Components are those of the program, when it has any.
+	Components []ComponentState `json:"components,omitempty"`
+	// Child is the program an Exec runs.
+	Child *ChildState `json:"child,omitempty"`
+}
+
+// ChildState is what status shows about the program an Exec runs.
+type ChildState struct {
+	Command string `json:"command"`
+	// Pid is 0 while the child is not running.
+	Pid     int        `json:"pid,omitempty"`
+	Started *time.Time `json:"started,omitempty"`
+	// Exit is how it last exited, nil until it first did.
+	Exit *ExitStatus `json:"exit,omitempty"`
+}
+
+func (this *ChildState) String() string {
+	s := this.Command
+	if this.Pid != 0 {
+		s += fmt.Sprintf(" (pid %d)", this.Pid)
+	} else {
+		s += " (not running)"
+	}
+	if this.Exit != nil {
+		s += ", last " + this.Exit.String()
+	}
+	return s
+}
+
+// ExitStatus is how a child exited.
+type ExitStatus struct {
+	Time time.Time `json:"time"`
+	// Code is the exit status, -1 when a signal killed the child.
+	Code   int    `json:"code"`
+	Signal string `json:"signal,omitempty"`
+}
+
+func (this *ExitStatus) String() string {
+	at := this.Time.Local().Format(time.RFC3339)
+	if this.Signal != "" {
+		return fmt.Sprintf("killed by signal %s at %s", this.Signal, at)
+	}
+	return fmt.Sprintf("exited with status %d at %s", this.Code, at)
+}
+
+// Identity is who the daemon runs as, after dropping privileges.
+type Identity struct {
+	User   string `json:"user"`
+	Uid    int    `json:"uid"`
+	Group  string `json:"group"`
+	Gid    int    `json:"gid"`
+	Groups []int  `json:"groups,omitempty"`
+	// Caps are the capabilities the daemon kept.
+	Caps       []string `json:"caps,omitempty"`
+	NoNewPrivs bool     `json:"no_new_privs,omitempty"`
+}
+
+func (this *Identity) String() string {
+	s := fmt.Sprintf("%s (uid %d), group %s (gid %d)", this.User, this.Uid, this.Group, this.Gid)
+	if len(this.Groups) > 0 {
+		s += fmt.Sprintf(", groups %v", this.Groups)
+	}
+	if len(this.Caps) > 0 {
+		s += ", keeps " + strings.Join(this.Caps, " ")
+	}
+	if this.NoNewPrivs {
+		s += ", no new privileges"
+	}
+	return s
+}
+
+// ProcessInfo is the limits and settings the daemon runs with.
+type ProcessInfo struct {
+	Limits           map[string]Limit `json:"limits"`
+	Umask            string           `json:"umask"`
+	WorkingDirectory string           `json:"working_directory"`
+	Nice             int              `json:"nice"`
+	// OOMScoreAdj is Linux only.
+	OOMScoreAdj *int `json:"oom_score_adj,omitempty"`
+}
+
+// Limit is a resource limit, -1 for unlimited.
+type Limit struct {
+	Soft int64 `json:"soft"`
+	Hard int64 `json:"hard"`
+}
+
+func (this Limit) String() string {
+	format := func(value int64) string {
+		if value < 0 {
+			return "unlimited"
+		}
+		return fmt.Sprint(value)
+	}
+	if this.Soft == this.Hard {
+		return format(this.Soft)
+	}
+	return fmt.Sprintf("%s (hard %s)", format(this.Soft), format(this.Hard))
+}
+
+// LimitsString lists the limits by name.
+func (this *ProcessInfo) LimitsString() string {
+	var names, limits []string
+	for name := range this.Limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		limits = append(limits, fmt.Sprintf("%s %s", name, this.Limits[name]))
+	}
+	return strings.Join(limits, ", ")
+}
+
+func (this *ProcessInfo) String() string {
+	s := fmt.Sprintf("umask %s, working directory %s, nice %d", this.Umask, this.WorkingDirectory, this.Nice)
+	if this.OOMScoreAdj != nil {
+		s += fmt.Sprintf(", oom_score_adj %d", *this.OOMScoreAdj)
+	}
+	return s
+}
+
+// ReloadReport is the outcome of the last config reload: the settings
+// that took effect, those that only a restart will pick up, or why the
+// new config was rejected.
+type ReloadReport struct {
+	Time    time.Time `json:"time"`
+	Applied []string  `json:"applied,omitempty"`
+	Restart []string  `json:"restart,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// ShutdownReport is what the daemon leaves in its state file when it
+// stops: how many connections finished within the drain timeout and how
+// many had to be closed under their handlers.
+type ShutdownReport struct {
+	Drained int `json:"drained"`
+	Killed  int `json:"killed"`
+	// Error is what the daemon failed with, empty when it was stopped.
+	Error string `json:"error,omitempty"`
+}
+
+// WriteStateFile replaces the state file at path with state.
+func WriteStateFile(path string, state *DaemonState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// write aside and rename, so readers never see a partial file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ReadStateFile returns the daemon state stored at path.
+func ReadStateFile(path string) (*DaemonState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := &DaemonState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("state file %s is corrupt: %v", path, err)
+	}
+	return state, nil
+}
+
+// UpgradeReport records why the last upgrade failed, leaving the old
+// process in charge.
+type UpgradeReport struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// ServiceStatus is the answer to the status command.
+type ServiceStatus struct {
+	Name      string       `json:"name"`
+	Backend   string       `json:"backend,omitempty"`
+	Installed bool         `json:"installed"`
+	State     string       `json:"state"`
+	Pid       int          `json:"pid,omitempty"`
+	Started   *time.Time   `json:"started,omitempty"`
+	Uptime    float64      `json:"uptime_seconds,omitempty"`
+	Listen    []string     `json:"listen,omitempty"`
+	Version   string       `json:"version,omitempty"`
+	Identity  *Identity    `json:"identity,omitempty"`
+	Process   *ProcessInfo `json:"process,omitempty"`
+	Detail    string       `json:"detail,omitempty"`
+	// Components are those of the program, when it has any.
+	Components []ComponentState `json:"components,omitempty"`
+	Child      *ChildState      `json:"child,omitempty"`
+}
+
+// ExitCode maps the state onto the LSB status exit codes.
+func (this *ServiceStatus) ExitCode() int {
+	switch this.State {
+	case StateRunning, StatePaused:
+		return LSBRunning
+	case StateDead:
+		return LSBDeadPidFile
+	case StateStopped:
+		return LSBNotRunning
+	}
+	return LSBUnknown
+}
+
+// applyDaemonState fills in what the daemon published about itself.
+func (this *ServiceStatus) applyDaemonState(state *DaemonState) {
+	this.State = state.State
+	this.Started = &state.Started
+	this.Uptime = time.Since(state.Started).Seconds()
+	this.Listen = state.Listen
+	if state.Version != "" {
+		this.Version = state.Version
+	}
+	this.Identity = state.Identity
+	this.Process = state.Process
+	this.Components = state.Components
+	this.Child = state.Child
+}
+
+// WriteJSON writes the status as a single JSON object.
+func (this *ServiceStatus) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(this)
+}
+
+// WriteText writes the status for humans.
+func (this *ServiceStatus) WriteText(w io.Writer) error {
+	state := this.State
+	if this.Pid != 0 {
+		state = fmt.Sprintf("%s (pid %d)", state, this.Pid)
+	}
+	installed := "no"
+	if this.Installed {
+		installed = "yes"
+	}
+	fmt.Fprintf(w, "%s: %s\n", this.Name, state)
+	if this.Backend != "" {
+		installed = fmt.Sprintf("%s (%s)", installed, this.Backend)
+	}
+	fmt.Fprintf(w, "  installed: %s\n", installed)
+	if this.Started != nil {
+		uptime := time.Duration(this.Uptime) * time.Second
+		fmt.Fprintf(w, "  started:   %s (up %s)\n", this.Started.Local().Format(time.RFC3339), uptime)
+	}
+	if len(this.Listen) > 0 {
+		fmt.Fprintf(w, "  listen:    %s\n", strings.Join(this.Listen, ", "))
+	}
+	if this.Version != "" {
+		fmt.Fprintf(w, "  version:   %s\n", this.Version)
+	}
+	if this.Identity != nil {
+		fmt.Fprintf(w, "  identity:  %s\n", this.Identity)
+	}
+	if this.Process != nil {
+		fmt.Fprintf(w, "  limits:    %s\n", this.Process.LimitsString())
+		fmt.Fprintf(w, "  process:   %s\n", this.Process)
+	}
+	if len(this.Components) > 0 {
+		fmt.Fprintf(w, "  components:\n")
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		for _, c := range this.Components {
+			fmt.Fprintf(tw, "    %s\t%s\n", c.Name, &c)
+		}
+		tw.Flush()
+	}
+	if this.Child != nil {
+		fmt.Fprintf(w, "  child:     %s\n", this.Child)
+	}
+	if this.Detail != "" {
+		fmt.Fprintf(w, "  detail:    %s\n", this.Detail)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package servicelib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var superviseRunTemplate = template.Must(template.New("run").Parse(`#!/bin/sh
+exec 2>&1
+exec "{{.Exe}}" run --foreground
+`))
+
+var superviseFinishTemplate = template.Must(template.New("finish").Parse(`#!/bin/sh
+# $1 is the exit code, $2 the signal that killed the daemon
+echo "{{.Name}} exited with status $1${2:+, signal $2}"
+# don't spin when the daemon cannot start
+[ "$1" = 0 ] || sleep 1
+`))
+
+var superviseLogTemplate = template.Must(template.New("log").Parse(`#!/bin/sh
+mkdir -p "{{.LogDir}}"
+exec {{.Logger}} "{{.LogDir}}"
+`))
+
+// superviseBackend creates a daemontools style service directory for
+// runit or s6 and links it into the directory the supervisor scans.
+// The daemon runs in the foreground under it and logs through log/run.
+type superviseBackend struct {
+	host   *Host
+	flavor string
+}
+
+func (this *superviseBackend) Name() string {
+	return this.flavor
+}
+
+func (this *superviseBackend) Detect() bool {
+	if this.flavor == "s6" {
+		_, ok := this.host.hasCommand("/command/s6-svscan", "/usr/bin/s6-svscan", "/bin/s6-svscan")
+		return this.host.exists("/run/s6") || ok
+	}
+	return this.host.exists("/run/runit") || this.host.exists("/etc/runit/runsvdir")
+}
+
+// svDir is where the service directory lives.
+func (this *superviseBackend) svDir() string {
+	if this.flavor == "s6" {
+		return "/etc/s6/sv/" + this.host.Name
+	}
+	return "/etc/sv/" + this.host.Name
+}
+
+// linkPath is the service's entry in the directory the supervisor scans:
+// /var/service on Void and /etc/service elsewhere for runit, /run/service
+// for s6-overlay and /service for a plain s6-svscan.
+func (this *superviseBackend) linkPath() string {
+	dirs := []string{"/var/service", "/etc/service"}
+	if this.flavor == "s6" {
+		dirs = []string{"/run/service", "/var/run/s6/services", "/service"}
+	}
+	for _, dir := range dirs {
+		if this.host.exists(dir) {
+			return filepath.Join(dir, this.host.Name)
+		}
+	}
+	return filepath.Join(dirs[len(dirs)-1], this.host.Name)
+}
+
+// logDir is where svlogd or s6-log keep the daemon's output.
+func (this *superviseBackend) logDir() string {
+	if dir := viper.GetString("log.logpath"); dir != "" {
+		return dir
+	}
+	return "/var/log/" + this.host.Name
+}
+
+func (this *superviseBackend) Files() ([]InstallFile, error) {
+	logger := "svlogd -tt"
+	if this.flavor == "s6" {
+		logger = "s6-log n10 s1000000 T"
+	}
+	var run, finish, log bytes.Buffer
+	if err := superviseRunTemplate.Execute(&run, this.host); err != nil {
+		return nil, err
+	}
+	if err := superviseFinishTemplate.Execute(&finish, this.host); err != nil {
+		return nil, err
+	}
+	err := superviseLogTemplate.Execute(&log, struct {
+		LogDir string
+		Logger string
+	}{this.logDir(), logger})
+	if err != nil {
+		return nil, err
+	}
+
+	dir := this.svDir()
+	return []InstallFile{
+		{Path: dir, Mode: os.ModeDir | 0755},
+		{Path: filepath.Join(dir, "run"), Mode: 0755, Data: run.Bytes()},
+		{Path: filepath.Join(dir, "finish"), Mode: 0755, Data: finish.Bytes()},
+		{Path: filepath.Join(dir, "log"), Mode: os.ModeDir | 0755},
+		{Path: filepath.Join(dir, "log", "run"), Mode: 0755, Data: log.Bytes()},
+		{Path: this.linkPath(), Mode: os.ModeSymlink | 0777, Link: dir},
+	}, nil
+}
+
+// Commands only take the service down before it is removed; linking
+// the service directory in is enough for the supervisor to start it.
+// The supervisor keeps its state in the service directory, which has to
+// go before the directory can.
+func (this *superviseBackend) Commands() Commands {
+	var cmds Commands
+	dir := this.svDir()
+	if this.flavor == "s6" {
+		if tool, ok := this.host.hasCommand("/command/s6-svc", "/usr/bin/s6-svc", "/bin/s6-svc"); ok {
+			cmds.Remove = append(cmds.Remove, []string{tool, "-d", dir})
+		}
+		// s6-svscan picks up a changed scan directory on its next pass,
+		// tell it to look now
+		if tool, ok := this.host.hasCommand("/command/s6-svscanctl", "/usr/bin/s6-svscanctl", "/bin/s6-svscanctl"); ok {
+			rescan := []string{tool, "-a", filepath.Dir(this.linkPath())}
+			cmds.Install = append(cmds.Install, rescan)
+			cmds.Cleanup = append(cmds.Cleanup, rescan)
+		}
+	} else if tool, ok := this.host.hasCommand("/usr/bin/sv", "/sbin/sv", "/usr/sbin/sv", "/bin/sv"); ok {
+		cmds.Remove = append(cmds.Remove, []string{tool, "down", dir})
+	}
+	cmds.Remove = append(cmds.Remove, []string{"rm", "-rf", filepath.Join(dir, "supervise"), filepath.Join(dir, "log", "supervise")})
+	return cmds
+}
+
+func (this *superviseBackend) Installed() bool {
+	return this.host.exists(this.svDir())
+}
+
+func (this *superviseBackend) Start() error {
+	if !this.Installed() {
+		return this.host.errNotInstalled(this.Name())
+	}
+	return this.control("u")
+}
+
+func (this *superviseBackend) Stop() error {
+	if !this.Installed() {
+		return this.host.errNotRunning()
+	}
+	return this.control("d")
+}
+
+// control sends cmd, u for up or d for down, to the supervisor. Without
+// sv or s6-svc at hand it writes to the supervise/control FIFO, which
+// both understand.
+func (this *superviseBackend) control(cmd string) error {
+	// the link may point outside a fake root, the directory is the same
+	dir := this.host.Path(this.svDir())
+	// a freshly linked service takes the supervisor a few seconds to see
+	ok := filepath.Join(dir, "supervise", "ok")
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(250 * time.Millisecond) {
+		if _, err := os.Stat(ok); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s is not supervised, is %s running?", this.host.Name, this.supervisor())
+		}
+	}
+
+	if this.flavor == "s6" {
+		if tool, found := this.host.hasCommand("/command/s6-svc", "/usr/bin/s6-svc", "/bin/s6-svc"); found {
+			return this.host.command(tool, "-"+cmd, dir)
+		}
+	} else if tool, found := this.host.hasCommand("/usr/bin/sv", "/sbin/sv", "/usr/sbin/sv", "/bin/sv"); found {
+		action := map[string]string{"u": "up", "d": "down"}[cmd]
+		return this.host.command(tool, action, dir)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, "supervise", "control"), os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return fmt.Errorf("%s is not supervised: %v", this.host.Name, err)
+	}
+	defer f.Close()
+	_, err = f.Write([]byte(cmd))
+	return err
+}
+
+func (this *superviseBackend) supervisor() string {
+	if this.flavor == "s6" {
+		return "s6-svscan"
+	}
+	return "runsvdir"
+}
+
+var s6PidRe = regexp.MustCompile(`^up \(pid ([0-9]+)\)`)
+
+// MainPid returns the pid the supervisor runs. runit keeps it in
+// supervise/pid, s6 only tells s6-svstat.
+func (this *superviseBackend) MainPid() (int, bool) {
+	dir := this.host.Path(this.svDir())
+	var pid int
+	if this.flavor == "s6" {
+		tool, ok := this.host.hasCommand("/command/s6-svstat", "/usr/bin/s6-svstat", "/bin/s6-svstat")
+		if !ok {
+			return 0, false
+		}
+		out, err := this.host.Run(tool, dir)
+		if err != nil {
+			return 0, false
+		}
+		m := s6PidRe.FindSubmatch(out)
+		if m == nil {
+			return 0, false
+		}
+		pid, _ = strconv.Atoi(string(m[1]))
+	} else {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "supervise", "pid"))
+		if err != nil {
+			return 0, false
+		}
+		pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	return pid, pid > 0
+}
@@ -0,0 +1,421 @@
+package servicelib
+
+import (
+	"context"
+	"fmt"
+	"github.com/oliveagle/ole_tryout_daemon/config"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Component states a Supervisor reports.
+const (
+	// ComponentStarting waits for the components it needs to be ready.
+	ComponentStarting = "starting"
+	ComponentRunning  = "running"
+	// ComponentBackoff waits to be restarted after it failed.
+	ComponentBackoff = "backoff"
+	// ComponentDone returned without an error, its work is done.
+	ComponentDone    = "done"
+	ComponentStopped = "stopped"
+	// ComponentFailed failed once more than the restart intensity
+	// allows, taking the supervisor down with it.
+	ComponentFailed = "failed"
+)
+
+// What a Supervisor uses for the fields left at zero.
+const (
+	DefaultMinBackoff    = 100 * time.Millisecond
+	DefaultMaxBackoff    = 30 * time.Second
+	DefaultMaxRestarts   = 10
+	DefaultRestartPeriod = time.Minute
+)
+
+// Component is a long-running part of a Program that a Supervisor runs,
+// like an accept loop, a ticker or a background job.
+type Component struct {
+	Name string
+	// After names the components this one needs. It starts once they
+	// are ready, and stops before them.
+	After []string
+	// Run does the work until ctx is cancelled, and returns nil then.
+	// Returning an error or panicking before has the supervisor restart
+	// it; returning nil means the work is done.
+	Run func(ctx context.Context) error
+	// NotifyReady has Run call ComponentReady once it serves; without
+	// it a component is ready as soon as Run is called.
+	NotifyReady bool
+	// Pause, Continue and Reload are called, when set, as the
+	// supervisor is paused, continued and reloaded.
+	Pause    func() error
+	Continue func() error
+	Reload   func(cfg *config.Config) error
+}
+
+// ComponentState is what status shows about a component.
+type ComponentState struct {
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"`
+	Restarts  int       `json:"restarts"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+func (this *ComponentState) String() string {
+	s := fmt.Sprintf("%s since %s, %d restarts", this.State, this.Since.Local().Format(time.RFC3339), this.Restarts)
+	if this.LastError != "" {
+		s += ", last error: " + this.LastError
+	}
+	return s
+}
+
+// Supervisor runs components: it starts each once those it needs are
+// ready, restarts those that fail with a growing backoff, and
+// stops them in reverse order. Once they fail more often than
+// MaxRestarts within RestartPeriod, it gives up and reports on Failed;
+// the daemon fails then, for the init system to restart it as a whole.
+//
+// A Supervisor is a Program: register it with NewService, or run one
+// from your own Program's Start and Stop.
+type Supervisor struct {
+	// MinBackoff is the wait before restarting a component that failed,
+	// doubling with every failure that follows up to MaxBackoff. One
+	// that ran for MaxBackoff before it failed starts over at
+	// MinBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxRestarts is how many restarts, of all components together,
+	// the supervisor makes within RestartPeriod.
+	MaxRestarts   int
+	RestartPeriod time.Duration
+
+	components []*Component
+	failed     chan error
+
+	mu       sync.Mutex
+	running  []*supervised
+	restarts []time.Time
+	gaveUp   bool
+}
+
+// supervised is a component the supervisor started.
+type supervised struct {
+	*Component
+	cancel context.CancelFunc
+	done   chan struct{}
+	// ready is closed the first time the component is ready
+	ready     chan struct{}
+	readyOnce sync.Once
+	// state is guarded by the supervisor's mu
+	state ComponentState
+}
+
+func (this *supervised) markReady() {
+	this.readyOnce.Do(func() { close(this.ready) })
+}
+
+type readyKey struct{}
+
+// ComponentReady tells the supervisor the component whose Run got ctx
+// is ready, when it has NotifyReady set; those that need it start then.
+func ComponentReady(ctx context.Context) {
+	if ready, ok := ctx.Value(readyKey{}).(func()); ok {
+		ready()
+	}
+}
+
+// NewSupervisor returns a supervisor for components, which it starts
+// once it is started itself.
+func NewSupervisor(components ...*Component) *Supervisor {
+	return &Supervisor{components: components, failed: make(chan error, 1)}
+}
+
+// startOrder sorts the components so each comes after those it needs,
+// keeping them in the order given otherwise.
+func (this *Supervisor) startOrder() ([]*Component, error) {
+	byName := map[string]*Component{}
+	for _, c := range this.components {
+		if c.Name == "" || c.Run == nil {
+			return nil, fmt.Errorf("supervisor: a component needs a name and Run")
+		}
+		if byName[c.Name] != nil {
+			return nil, fmt.Errorf("supervisor: two components are called %s", c.Name)
+		}
+		byName[c.Name] = c
+	}
+	var order []*Component
+	// 1 while visiting its dependencies, 2 once in order
+	mark := map[string]int{}
+	var visit func(c *Component, path []string) error
+	visit = func(c *Component, path []string) error {
+		switch mark[c.Name] {
+		case 1:
+			return fmt.Errorf("supervisor: components depend on each other: %v", append(path, c.Name))
+		case 2:
+			return nil
+		}
+		mark[c.Name] = 1
+		for _, name := range c.After {
+			dep := byName[name]
+			if dep == nil {
+				return fmt.Errorf("supervisor: %s needs %s, which is not a component", c.Name, name)
+			}
+			if err := visit(dep, append(path, c.Name)); err != nil {
+				return err
+			}
+		}
+		mark[c.Name] = 2
+		order = append(order, c)
+		return nil
+	}
+	for _, c := range this.components {
+		if err := visit(c, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// Start starts the components and returns. Each runs once those it
+// needs were ready, the first time: one restarted later is not waited
+// for again. They run until Stop, or until ctx is cancelled.
+func (this *Supervisor) Start(ctx context.Context) error {
+	order, err := this.startOrder()
+	if err != nil {
+		return err
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	byName := map[string]*supervised{}
+	for _, c := range order {
+		cctx, cancel := context.WithCancel(ctx)
+		s := &supervised{Component: c, cancel: cancel, done: make(chan struct{}), ready: make(chan struct{})}
+		s.state = ComponentState{Name: c.Name, State: ComponentRunning, Since: time.Now()}
+		var needs []*supervised
+		for _, name := range c.After {
+			needs = append(needs, byName[name])
+		}
+		if len(needs) > 0 {
+			s.state.State = ComponentStarting
+		}
+		byName[c.Name] = s
+		this.running = append(this.running, s)
+		go this.supervise(cctx, s, needs)
+	}
+	return nil
+}
+
+// Stop stops the components in reverse order, each once those that
+// need it have returned. Components still running when ctx expires are
+// left behind, cancelled.
+func (this *Supervisor) Stop(ctx context.Context) error {
+	this.mu.Lock()
+	running := this.running
+	this.mu.Unlock()
+	for i := len(running) - 1; i >= 0; i-- {
+		s := running[i]
+		s.cancel()
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			for _, s := range running[:i] {
+				s.cancel()
+			}
+			return fmt.Errorf("supervisor: %s did not stop in time", s.Name)
+		}
+	}
+	return nil
+}
+
+// Pause, Continue and Reload pass the call on to the components in the
+// order they started, and stop at the first that fails. Those before
+// it keep what they did; for Reload, a component that can reject a
+// config should come first.
+func (this *Supervisor) Pause() error {
+	return this.each(func(c *Component) error {
+		if c.Pause == nil {
+			return nil
+		}
+		return c.Pause()
+	})
+}
+
+func (this *Supervisor) Continue() error {
+	return this.each(func(c *Component) error {
+		if c.Continue == nil {
+			return nil
+		}
+		return c.Continue()
+	})
+}
+
+func (this *Supervisor) Reload(cfg *config.Config) error {
+	return this.each(func(c *Component) error {
+		if c.Reload == nil {
+			return nil
+		}
+		return c.Reload(cfg)
+	})
+}
+
+func (this *Supervisor) each(call func(c *Component) error) error {
+	this.mu.Lock()
+	running := this.running
+	this.mu.Unlock()
+	for _, s := range running {
+		if err := call(s.Component); err != nil {
+			return fmt.Errorf("%s: %v", s.Name, err)
+		}
+	}
+	return nil
+}
+
+// Failed reports the error the supervisor gave up with.
+func (this *Supervisor) Failed() <-chan error {
+	return this.failed
+}
+
+// Components returns the state of the components, in the order they
+// started.
+func (this *Supervisor) Components() []ComponentState {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	states := make([]ComponentState, 0, len(this.running))
+	for _, s := range this.running {
+		states = append(states, s.state)
+	}
+	return states
+}
+
+func (this *Supervisor) setState(s *supervised, state string, err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	s.state.State = state
+	s.state.Since = time.Now()
+	if err != nil {
+		s.state.LastError = err.Error()
+	}
+	if state == ComponentBackoff {
+		s.state.Restarts++
+	}
+}
+
+// intensity returns MaxRestarts and RestartPeriod, or their defaults.
+func (this *Supervisor) intensity() (int, time.Duration) {
+	max, period := this.MaxRestarts, this.RestartPeriod
+	if max == 0 {
+		max = DefaultMaxRestarts
+	}
+	if period == 0 {
+		period = DefaultRestartPeriod
+	}
+	return max, period
+}
+
+// restartAllowed records a restart, unless it would be one too many
+// within the restart period.
+func (this *Supervisor) restartAllowed() bool {
+	max, period := this.intensity()
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	now := time.Now()
+	recent := this.restarts[:0]
+	for _, t := range this.restarts {
+		if now.Sub(t) < period {
+			recent = append(recent, t)
+		}
+	}
+	this.restarts = recent
+	if len(recent) >= max || this.gaveUp {
+		this.gaveUp = true
+		return false
+	}
+	this.restarts = append(this.restarts, now)
+	return true
+}
+
+// supervise runs s, once the components it needs are ready, until its
+// ctx is cancelled, restarting it when it fails.
+func (this *Supervisor) supervise(ctx context.Context, s *supervised, needs []*supervised) {
+	defer close(s.done)
+	for _, dep := range needs {
+		select {
+		case <-dep.ready:
+		case <-ctx.Done():
+			this.setState(s, ComponentStopped, nil)
+			return
+		}
+	}
+	if len(needs) > 0 {
+		this.setState(s, ComponentRunning, nil)
+	}
+	runCtx := ctx
+	if s.NotifyReady {
+		runCtx = context.WithValue(ctx, readyKey{}, s.markReady)
+	}
+	minBackoff, maxBackoff := this.MinBackoff, this.MaxBackoff
+	if minBackoff == 0 {
+		minBackoff = DefaultMinBackoff
+	}
+	if maxBackoff == 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+	backoff := minBackoff
+	for {
+		started := time.Now()
+		if !s.NotifyReady {
+			s.markReady()
+		}
+		err := runComponent(runCtx, s.Component)
+		if ctx.Err() != nil {
+			this.setState(s, ComponentStopped, err)
+			return
+		}
+		if err == nil {
+			log.Printf("supervisor: %s is done\r\n", s.Name)
+			this.setState(s, ComponentDone, nil)
+			// its work is done, nothing to wait for
+			s.markReady()
+			return
+		}
+		if time.Since(started) >= maxBackoff {
+			backoff = minBackoff
+		}
+		if !this.restartAllowed() {
+			log.Printf("supervisor: %s failed: %v, giving up\r\n", s.Name, err)
+			this.setState(s, ComponentFailed, err)
+			max, period := this.intensity()
+			select {
+			case this.failed <- fmt.Errorf("%s failed: %v, after %d restarts within %v", s.Name, err, max, period):
+			default:
+				// another component gave up first
+			}
+			return
+		}
+		log.Printf("supervisor: %s failed: %v, restarting in %v\r\n", s.Name, err, backoff)
+		this.setState(s, ComponentBackoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			this.setState(s, ComponentStopped, nil)
+			return
+		}
+		this.setState(s, ComponentRunning, nil)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// runComponent runs c, turning a panic into an error.
+func runComponent(ctx context.Context, c *Component) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("supervisor: %s panicked: %v\r\n%s\r\n", c.Name, r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return c.Run(ctx)
+}
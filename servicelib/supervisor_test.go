@@ -0,0 +1,298 @@
+package servicelib
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// idle is a Component.Run that waits to be stopped.
+func idle(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+// waitRunning waits for all of the supervisor's components to run.
+func waitRunning(t *testing.T, sup *Supervisor) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		all := true
+		for _, state := range sup.Components() {
+			all = all && state.State == ComponentRunning
+		}
+		if all {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not all running: %v", sup.Components())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSupervisorOrder(t *testing.T) {
+	var mu sync.Mutex
+	var stopped []string
+	component := func(name string, after ...string) *Component {
+		return &Component{Name: name, After: after, Run: func(ctx context.Context) error {
+			<-ctx.Done()
+			mu.Lock()
+			stopped = append(stopped, name)
+			mu.Unlock()
+			return nil
+		}}
+	}
+	sup := NewSupervisor(
+		component("web", "cache", "db"),
+		component("cache", "db"),
+		component("db"),
+		component("ticker"),
+	)
+	if err := sup.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var started []string
+	for _, state := range sup.Components() {
+		started = append(started, state.Name)
+	}
+	if want := []string{"db", "cache", "web", "ticker"}; !reflect.DeepEqual(started, want) {
+		t.Errorf("started %v, want %v", started, want)
+	}
+
+	waitRunning(t, sup)
+	if err := sup.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ticker", "web", "cache", "db"}; !reflect.DeepEqual(stopped, want) {
+		t.Errorf("stopped %v, want %v", stopped, want)
+	}
+}
+
+func TestSupervisorWaitsForDependency(t *testing.T) {
+	dbReady := make(chan time.Time, 1)
+	webStarted := make(chan time.Time, 1)
+	sup := NewSupervisor(
+		&Component{Name: "web", After: []string{"db"}, Run: func(ctx context.Context) error {
+			webStarted <- time.Now()
+			return idle(ctx)
+		}},
+		&Component{Name: "db", NotifyReady: true, Run: func(ctx context.Context) error {
+			// a slow start
+			time.Sleep(50 * time.Millisecond)
+			dbReady <- time.Now()
+			ComponentReady(ctx)
+			return idle(ctx)
+		}},
+	)
+	if err := sup.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Stop(context.Background())
+	if state := sup.Components()[1]; state.Name != "web" || state.State != ComponentStarting {
+		t.Errorf("right after Start %+v, want web %s", state, ComponentStarting)
+	}
+
+	var ready, started time.Time
+	select {
+	case started = <-webStarted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("web never started")
+	}
+	select {
+	case ready = <-dbReady:
+	default:
+		t.Fatal("web started before db was ready")
+	}
+	if started.Before(ready) {
+		t.Errorf("web started at %v, before db was ready at %v", started, ready)
+	}
+	if state := sup.Components()[1]; state.State != ComponentRunning {
+		t.Errorf("web is %s once started, want %s", state.State, ComponentRunning)
+	}
+}
+
+func TestSupervisorDependencyErrors(t *testing.T) {
+	tests := []struct {
+		components []*Component
+		want       string
+	}{
+		{
+			[]*Component{
+				{Name: "a", After: []string{"c"}, Run: idle},
+				{Name: "b", After: []string{"a"}, Run: idle},
+				{Name: "c", After: []string{"b"}, Run: idle},
+			},
+			"components depend on each other: [a c b a]",
+		},
+		{
+			[]*Component{{Name: "a", After: []string{"a"}, Run: idle}},
+			"components depend on each other: [a a]",
+		},
+		{
+			[]*Component{{Name: "a", After: []string{"db"}, Run: idle}},
+			"a needs db, which is not a component",
+		},
+		{
+			[]*Component{{Name: "a", Run: idle}, {Name: "a", Run: idle}},
+			"two components are called a",
+		},
+		{
+			[]*Component{{Name: "a"}},
+			"a component needs a name and Run",
+		},
+	}
+	for _, test := range tests {
+		sup := NewSupervisor(test.components...)
+		err := sup.Start(context.Background())
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("got %v, want %q", err, test.want)
+		}
+		if states := sup.Components(); len(states) != 0 {
+			t.Errorf("started %v after an error", states)
+		}
+	}
+}
+
+func TestSupervisorBackoff(t *testing.T) {
+	const min, max = 20 * time.Millisecond, 160 * time.Millisecond
+	var mu sync.Mutex
+	var starts, ends []time.Time
+	done := make(chan struct{})
+	run := func(ctx context.Context) error {
+		mu.Lock()
+		starts = append(starts, time.Now())
+		n := len(starts)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			ends = append(ends, time.Now())
+			mu.Unlock()
+		}()
+		switch {
+		case n == 4:
+			// running for max resets the backoff
+			time.Sleep(max + 10*time.Millisecond)
+		case n == 6:
+			close(done)
+			return nil
+		}
+		return errors.New("flaky")
+	}
+	sup := NewSupervisor(&Component{Name: "flaky", Run: run})
+	sup.MinBackoff, sup.MaxBackoff = min, max
+	sup.MaxRestarts, sup.RestartPeriod = 100, time.Minute
+	if err := sup.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Stop(context.Background())
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not restarted five times")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var waits []time.Duration
+	for i := 1; i < len(starts); i++ {
+		waits = append(waits, starts[i].Sub(ends[i-1]))
+	}
+	// doubling from min; after the long run from min again
+	for i, want := range []time.Duration{min, 2 * min, 4 * min, min, 2 * min} {
+		if waits[i] < want {
+			t.Errorf("restart %d after %v, want %v", i+1, waits[i], want)
+		}
+	}
+	if waits[3] >= 8*min {
+		t.Errorf("restart after running for %v took %v, want the backoff reset to %v", max, waits[3], min)
+	}
+	if state := sup.Components()[0]; state.Restarts != 5 || state.LastError != "flaky" {
+		t.Errorf("state %+v, want 5 restarts after flaky", state)
+	}
+}
+
+func TestSupervisorGivesUp(t *testing.T) {
+	var mu sync.Mutex
+	runs := 0
+	sup := NewSupervisor(
+		&Component{Name: "steady", Run: idle},
+		&Component{Name: "crashing", Run: func(ctx context.Context) error {
+			mu.Lock()
+			runs++
+			mu.Unlock()
+			panic("boom")
+		}},
+	)
+	sup.MinBackoff = time.Millisecond
+	sup.MaxRestarts, sup.RestartPeriod = 3, time.Minute
+	if err := sup.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Stop(context.Background())
+
+	select {
+	case err := <-sup.Failed():
+		if want := "crashing failed: panic: boom, after 3 restarts within 1m0s"; err == nil || err.Error() != want {
+			t.Errorf("failed with %v, want %q", err, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not give up")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if runs != 4 {
+		t.Errorf("ran %d times, want the first run and 3 restarts", runs)
+	}
+	states := sup.Components()
+	if states[0].State != ComponentRunning {
+		t.Errorf("steady is %s, want %s", states[0].State, ComponentRunning)
+	}
+	if states[1].State != ComponentFailed || states[1].Restarts != 3 {
+		t.Errorf("crashing is %+v, want %s after 3 restarts", states[1], ComponentFailed)
+	}
+}
+
+func TestSupervisorStopTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	cancelled := make(chan struct{})
+	running := make(chan struct{})
+	sup := NewSupervisor(
+		&Component{Name: "db", Run: func(ctx context.Context) error {
+			<-ctx.Done()
+			close(cancelled)
+			return nil
+		}},
+		&Component{Name: "stubborn", After: []string{"db"}, Run: func(ctx context.Context) error {
+			close(running)
+			// ignores ctx
+			<-release
+			return nil
+		}},
+	)
+	if err := sup.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-running
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	err := sup.Stop(ctx)
+	if err == nil || err.Error() != "supervisor: stubborn did not stop in time" {
+		t.Errorf("got %v, want stubborn not stopping in time", err)
+	}
+	if took := time.Since(begin); took > time.Second {
+		t.Errorf("Stop returned after %v, past its deadline", took)
+	}
+	// those it did not get to are cancelled all the same
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("db was not cancelled")
+	}
+}
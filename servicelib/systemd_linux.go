@@ -0,0 +1,201 @@
+package servicelib
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/oliveagle/ole_tryout_daemon/config"
+	"github.com/spf13/viper"
+)
+
+var socketUnitTemplate = template.Must(template.New("socket").Parse(`[Unit]
+Description={{.Description}} socket
+
+[Socket]
+ListenStream={{.Listen}}
+
+[Install]
+WantedBy=sockets.target
+`))
+
+// systemdBackend installs a unit built from the [service] config, plus a
+// .socket unit when daemon.socket_activation is on. With user set it
+// installs into the user's own service manager, systemctl --user, and
+// needs no root.
+type systemdBackend struct {
+	host *Host
+	user bool
+}
+
+func (this *systemdBackend) Name() string {
+	if this.user {
+		return "systemd-user"
+	}
+	return "systemd"
+}
+
+// Detect picks the user's service manager only for a user who installed
+// the service there, so start, stop and status find it on their own.
+func (this *systemdBackend) Detect() bool {
+	if !this.host.exists("/run/systemd/system") {
+		return false
+	}
+	if this.user {
+		return os.Geteuid() != 0 && this.Installed()
+	}
+	return true
+}
+
+// args adds --user to a systemctl command line for the user's manager.
+func (this *systemdBackend) args(args ...string) []string {
+	if this.user {
+		return append([]string{"--user"}, args...)
+	}
+	return args
+}
+
+func (this *systemdBackend) unitDir() string {
+	if this.user {
+		return filepath.Join(config.UserConfigDir(), "systemd", "user")
+	}
+	return "/etc/systemd/system"
+}
+
+func (this *systemdBackend) unitPath() string {
+	return filepath.Join(this.unitDir(), this.host.Name+".service")
+}
+
+func (this *systemdBackend) socketPath() string {
+	return filepath.Join(this.unitDir(), this.host.Name+".socket")
+}
+
+func (this *systemdBackend) dropinDir() string {
+	return filepath.Join(this.unitDir(), this.host.Name+".service.d")
+}
+
+// listenStream turns a daemon.listen address into a ListenStream= value.
+// An address without a host listens on all interfaces, which systemd
+// spells as the bare port.
+func listenStream(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		return port, nil
+	}
+	return addr, nil
+}
+
+// Files returns the service unit and its drop-ins. With socket
+// activation on, a .socket unit has systemd bind daemon.listen and start
+// the service on the first connection; systemd hands the socket to the
+// service unit of the same name.
+func (this *systemdBackend) Files() ([]InstallFile, error) {
+	opts, err := unitOptions()
+	if err != nil {
+		return nil, err
+	}
+	var unit bytes.Buffer
+	if err := opts.WriteSystemdUnit(&unit, this.host.Desc, this.host.Exe, this.user); err != nil {
+		return nil, err
+	}
+	files := []InstallFile{{Path: this.unitPath(), Mode: 0644, Data: unit.Bytes()}}
+
+	if len(opts.Dropins) > 0 {
+		files = append(files, InstallFile{Path: this.dropinDir(), Mode: os.ModeDir | 0755})
+	}
+	for _, dropin := range opts.DropinNames() {
+		files = append(files, InstallFile{
+			Path: filepath.Join(this.dropinDir(), dropin+".conf"),
+			Mode: 0644,
+			Data: []byte(opts.Dropins[dropin]),
+		})
+	}
+
+	if viper.GetBool("daemon.socket_activation") {
+		stream, err := listenStream(viper.GetString("daemon.listen"))
+		if err != nil {
+			return nil, fmt.Errorf("daemon.listen: %v", err)
+		}
+		var socket bytes.Buffer
+		err = socketUnitTemplate.Execute(&socket, struct {
+			Description string
+			Listen      string
+		}{this.host.Desc, stream})
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, InstallFile{Path: this.socketPath(), Mode: 0644, Data: socket.Bytes()})
+	}
+	return files, nil
+}
+
+// Commands enable the units. Removing stops the socket first, or a
+// connection could start the service again.
+func (this *systemdBackend) Commands() Commands {
+	systemctl := func(args ...string) []string {
+		return append([]string{"systemctl"}, this.args(args...)...)
+	}
+	var cmds Commands
+	cmds.Install = append(cmds.Install, systemctl("daemon-reload"), systemctl("enable", this.host.Name+".service"))
+	if viper.GetBool("daemon.socket_activation") {
+		cmds.Install = append(cmds.Install, systemctl("enable", this.host.Name+".socket"))
+		cmds.Remove = append(cmds.Remove, systemctl("stop", this.host.Name+".socket"), systemctl("disable", this.host.Name+".socket"))
+	}
+	cmds.Remove = append(cmds.Remove, systemctl("stop", this.host.Name+".service"), systemctl("disable", this.host.Name+".service"))
+	cmds.Cleanup = append(cmds.Cleanup, systemctl("daemon-reload"))
+	return cmds
+}
+
+func (this *systemdBackend) Installed() bool {
+	return this.host.exists(this.unitPath())
+}
+
+// Start starts the .socket unit first, if there is one, so the port is
+// bound before the service itself starts.
+func (this *systemdBackend) Start() error {
+	if !this.Installed() {
+		return this.host.errNotInstalled(this.Name())
+	}
+	if this.host.exists(this.socketPath()) {
+		if err := this.host.command("systemctl", this.args("start", this.host.Name+".socket")...); err != nil {
+			return err
+		}
+	}
+	return this.host.command("systemctl", this.args("start", this.host.Name+".service")...)
+}
+
+func (this *systemdBackend) Stop() error {
+	if !this.Installed() {
+		return this.host.errNotRunning()
+	}
+	return this.host.command("systemctl", this.args("stop", this.host.Name+".service")...)
+}
+
+func (this *systemdBackend) MainPid() (int, bool) {
+	out, err := this.host.Run("systemctl", this.args("show", "-p", "ActiveState", "-p", "MainPID", this.host.Name+".service")...)
+	if err != nil {
+		return 0, false
+	}
+	pid, active := 0, false
+	for _, line := range strings.Split(string(out), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "ActiveState":
+			active = kv[1] == "active" || kv[1] == "reloading"
+		case "MainPID":
+			pid, _ = strconv.Atoi(kv[1])
+		}
+	}
+	return pid, active && pid > 0
+}
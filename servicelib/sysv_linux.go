@@ -0,0 +1,235 @@
+package servicelib
+
+import (
+	"bytes"
+	"text/template"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var sysvScriptTemplate = template.Must(template.New("sysv").Parse(`#!/bin/sh
+### BEGIN INIT INFO
+# Provides:          {{.Name}}
+# Required-Start:    $network $remote_fs $syslog{{range .Dependencies}} {{.}}{{end}}
+# Required-Stop:     $network $remote_fs $syslog{{range .Dependencies}} {{.}}{{end}}
+# Default-Start:     2 3 4 5
+# Default-Stop:      0 1 6
+# Short-Description: {{.Desc}}
+# Description:       {{.Desc}}
+### END INIT INFO
+# chkconfig: 2345 80 20
+# description: {{.Desc}}
+
+NAME="{{.Name}}"
+DAEMON="{{.Exe}}"
+PIDFILE="{{.PidFile}}"
+# the daemon gets its drain timeout to close connections, and then some
+STOP_TIMEOUT={{.StopTimeout}}
+
+[ -x "$DAEMON" ] || exit 5
+
+# running sets pid and succeeds when the process in the pid file lives.
+# The daemon removes its pid file when it exits cleanly.
+running() {
+	pid=$(cat "$PIDFILE" 2>/dev/null) || return 1
+	[ -n "$pid" ] && kill -0 "$pid" 2>/dev/null
+}
+
+do_start() {
+	if running; then
+		echo "$NAME is already running (pid $pid)"
+		return 0
+	fi
+	printf "Starting %s: " "$NAME"
+	"$DAEMON" run </dev/null >/dev/null 2>&1 &
+	child=$!
+	i=0
+	while [ $i -lt 30 ]; do
+		# the pid may be that of a copy running as daemon.user
+		if running; then
+			echo "ok"
+			return 0
+		fi
+		# gone before writing its pid file, the log says why
+		kill -0 "$child" 2>/dev/null || break
+		sleep 1
+		i=$((i + 1))
+	done
+	if running; then
+		echo "ok"
+		return 0
+	fi
+	echo "failed"
+	return 1
+}
+
+do_stop() {
+	if ! running; then
+		echo "$NAME is not running"
+		return 0
+	fi
+	printf "Stopping %s: " "$NAME"
+	kill -TERM "$pid"
+	i=0
+	while [ $i -lt $STOP_TIMEOUT ]; do
+		if ! kill -0 "$pid" 2>/dev/null; then
+			echo "ok"
+			return 0
+		fi
+		sleep 1
+		i=$((i + 1))
+	done
+	echo "failed"
+	return 1
+}
+
+do_status() {
+	if running; then
+		echo "$NAME is running (pid $pid)"
+		return 0
+	fi
+	if [ -f "$PIDFILE" ]; then
+		echo "$NAME is dead, but $PIDFILE exists"
+		return 1
+	fi
+	echo "$NAME is not running"
+	return 3
+}
+
+do_reload() {
+	if ! running; then
+		echo "$NAME is not running"
+		return 7
+	fi
+	kill -HUP "$pid"
+}
+
+case "$1" in
+start)
+	do_start
+	;;
+stop)
+	do_stop
+	;;
+restart|force-reload)
+	do_stop && do_start
+	;;
+try-restart|condrestart)
+	if running; then
+		do_stop && do_start
+	fi
+	;;
+status)
+	do_status
+	;;
+reload)
+	do_reload
+	;;
+*)
+	echo "Usage: $0 {start|stop|restart|try-restart|reload|force-reload|status}" >&2
+	exit 2
+	;;
+esac
+`))
+
+// sysvScript generates the init script. Everything the script needs is
+// written into it, it does not read config.toml.
+func sysvScript(host *Host) ([]byte, error) {
+	opts, err := unitOptions()
+	if err != nil {
+		return nil, err
+	}
+	var script bytes.Buffer
+	err = sysvScriptTemplate.Execute(&script, struct {
+		*Host
+		Dependencies []string
+		PidFile      string
+		StopTimeout  int
+	}{
+		Host:         host,
+		Dependencies: opts.Dependencies,
+		PidFile:      PidFilePath(host.Name),
+		StopTimeout:  int((viper.GetDuration("daemon.drain_timeout") + 10*time.Second).Seconds()),
+	})
+	return script.Bytes(), err
+}
+
+// sysvBackend installs an init script in /etc/init.d and links it into
+// the runlevels with update-rc.d or chkconfig. The script drives the
+// daemon through its pid file on its own, without this binary's help.
+type sysvBackend struct {
+	host *Host
+}
+
+func (this *sysvBackend) Name() string {
+	return "sysv"
+}
+
+func (this *sysvBackend) Detect() bool {
+	if !this.host.exists("/etc/init.d") {
+		return false
+	}
+	_, ok := this.rcTool()
+	return ok || this.host.exists("/etc/inittab")
+}
+
+// rcTool finds the tool that links init scripts into the runlevels.
+func (this *sysvBackend) rcTool() (string, bool) {
+	return this.host.hasCommand("/usr/sbin/update-rc.d", "/sbin/update-rc.d",
+		"/sbin/chkconfig", "/usr/sbin/chkconfig")
+}
+
+func (this *sysvBackend) scriptPath() string {
+	return "/etc/init.d/" + this.host.Name
+}
+
+func (this *sysvBackend) Files() ([]InstallFile, error) {
+	script, err := sysvScript(this.host)
+	if err != nil {
+		return nil, err
+	}
+	return []InstallFile{{Path: this.scriptPath(), Mode: 0755, Data: script}}, nil
+}
+
+func (this *sysvBackend) Commands() Commands {
+	cmds := Commands{Remove: [][]string{{this.scriptPath(), "stop"}}}
+	tool, ok := this.rcTool()
+	switch {
+	case !ok:
+	case isChkconfig(tool):
+		cmds.Install = append(cmds.Install, []string{tool, "--add", this.host.Name})
+		cmds.Remove = append(cmds.Remove, []string{tool, "--del", this.host.Name})
+	default:
+		cmds.Install = append(cmds.Install, []string{tool, this.host.Name, "defaults"})
+		cmds.Remove = append(cmds.Remove, []string{tool, "-f", this.host.Name, "remove"})
+	}
+	return cmds
+}
+
+func isChkconfig(tool string) bool {
+	return tool == "/sbin/chkconfig" || tool == "/usr/sbin/chkconfig"
+}
+
+func (this *sysvBackend) Installed() bool {
+	return this.host.exists(this.scriptPath())
+}
+
+func (this *sysvBackend) Start() error {
+	if !this.Installed() {
+		return this.host.errNotInstalled(this.Name())
+	}
+	return this.host.command(this.host.Path(this.scriptPath()), "start")
+}
+
+func (this *sysvBackend) Stop() error {
+	if !this.Installed() {
+		return this.host.errNotRunning()
+	}
+	return this.host.command(this.host.Path(this.scriptPath()), "stop")
+}
+
+// MainPid never finds a pid, init does not watch what its scripts start.
+func (this *sysvBackend) MainPid() (int, bool) {
+	return 0, false
+}
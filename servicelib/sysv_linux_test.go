@@ -0,0 +1,71 @@
+package servicelib
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestSysvScript(t *testing.T) {
+	testConfig(t)
+	viper.Set("service.dependencies", []string{"postgresql"})
+	host, rec := fakeHost(t, "/etc/init.d/", "/usr/sbin/update-rc.d")
+	backend, err := SelectBackend(host, "sysv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := backend.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := host.writeFiles(files); err != nil {
+		t.Fatal(err)
+	}
+	script, err := os.ReadFile(host.Path("/etc/init.d/oleservice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.calls) != 0 {
+		t.Errorf("rendering the script ran %v", rec.calls)
+	}
+
+	golden := filepath.Join("testdata", "oleservice.init.golden")
+	if *update {
+		os.MkdirAll("testdata", 0755)
+		if err := os.WriteFile(golden, script, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("%v, run go test -update to write it", err)
+	}
+	if !bytes.Equal(script, want) {
+		t.Errorf("the script differs from %s, run go test -update if that is intended:\n%s", golden, script)
+	}
+
+	header := string(script)
+	if i := strings.Index(header, "### END INIT INFO"); i >= 0 {
+		header = header[:i]
+	}
+	for _, line := range []string{
+		"# Provides:          oleservice\n",
+		"# Required-Start:    $network $remote_fs $syslog postgresql\n",
+		"# Required-Stop:     $network $remote_fs $syslog postgresql\n",
+		"# Default-Start:     2 3 4 5\n",
+		"# Default-Stop:      0 1 6\n",
+		"# Short-Description: " + host.Desc + "\n",
+		"# Description:       " + host.Desc + "\n",
+	} {
+		if !strings.Contains(header, line) {
+			t.Errorf("the LSB header lacks %q", line)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package servicelib
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/oliveagle/ole_tryout_daemon/config"
+	"github.com/spf13/viper"
+)
+
+// UnitOptions are the [service] settings a generated service definition
+// is built from.
+type UnitOptions struct {
+	User             string
+	Group            string
+	Restart          string
+	RestartSec       time.Duration
+	WatchdogSec      time.Duration
+	Environment      []string
+	LimitNOFILE      int
+	WorkingDirectory string
+	Args             []string
+	// Dependencies are services that must run before this one, by the
+	// name the init system knows them by.
+	Dependencies []string
+	// Dropins maps a drop-in name to its contents, written to
+	// <name>.service.d/<key>.conf next to the unit.
+	Dropins map[string]string
+	// RuntimeDirectory is the directory below /run that holds the pid
+	// file, which the init system creates for User.
+	RuntimeDirectory string
+}
+
+// unitOptions reads the [service] section of the config.
+func unitOptions() (*UnitOptions, error) {
+	opts := &UnitOptions{
+		User:             viper.GetString("service.user"),
+		Group:            viper.GetString("service.group"),
+		Restart:          viper.GetString("service.restart"),
+		RestartSec:       viper.GetDuration("service.restart_sec"),
+		WatchdogSec:      viper.GetDuration("service.watchdog_sec"),
+		Environment:      viper.GetStringSlice("service.environment"),
+		LimitNOFILE:      viper.GetInt("service.limit_nofile"),
+		WorkingDirectory: viper.GetString("service.working_directory"),
+		Args:             viper.GetStringSlice("service.args"),
+		Dependencies:     viper.GetStringSlice("service.dependencies"),
+		Dropins:          viper.GetStringMapString("service.dropins"),
+		RuntimeDirectory: runtimeDirectory(viper.GetString("daemon.pidfile")),
+	}
+	return opts, opts.Validate()
+}
+
+// runtimeDirectory returns the directory of pidfile relative to /run, or
+// "" when it is not in a directory of its own there.
+func runtimeDirectory(pidfile string) string {
+	dir := filepath.Dir(pidfile)
+	for _, run := range []string{"/run/", "/var/run/"} {
+		if strings.HasPrefix(dir, run) {
+			return strings.TrimPrefix(dir, run)
+		}
+	}
+	return ""
+}
+
+// Validate checks the options for values systemd would reject.
+func (this *UnitOptions) Validate() error {
+	switch this.Restart {
+	case "", "no", "on-success", "on-failure", "on-abnormal", "on-watchdog", "on-abort", "always":
+	default:
+		return fmt.Errorf("service.restart: unknown policy %q", this.Restart)
+	}
+	if this.RestartSec < 0 {
+		return fmt.Errorf("service.restart_sec must not be negative")
+	}
+	if this.WatchdogSec < 0 {
+		return fmt.Errorf("service.watchdog_sec must not be negative")
+	}
+	if this.LimitNOFILE < 0 {
+		return fmt.Errorf("service.limit_nofile must not be negative")
+	}
+	for _, kv := range this.Environment {
+		if i := strings.Index(kv, "="); i < 1 {
+			return fmt.Errorf("service.environment: %q is not KEY=value", kv)
+		}
+	}
+	for _, dep := range this.Dependencies {
+		if dep == "" || strings.ContainsAny(dep, " \t\n/\"'$") {
+			return fmt.Errorf("service.dependencies: bad service name %q", dep)
+		}
+	}
+	for name := range this.Dropins {
+		if name == "" || strings.ContainsAny(name, "/.") {
+			return fmt.Errorf("service.dropins: bad drop-in name %q", name)
+		}
+	}
+	return nil
+}
+
+// DropinNames returns the drop-in names in a stable order.
+func (this *UnitOptions) DropinNames() []string {
+	var names []string
+	for name := range this.Dropins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var serviceUnitTemplate = template.Must(template.New("service").Funcs(template.FuncMap{
+	"quote": unitQuote,
+	"arg":   execArg,
+	"unit":  unitName,
+	"sec":   unitSeconds,
+}).Parse(`[Unit]
+Description={{.Description}}
+After=network.target{{range .Dependencies}} {{unit .}}{{end}}
+{{- if and .Dependencies (not .UserUnit)}}
+Requires={{range $i, $dep := .Dependencies}}{{if $i}} {{end}}{{unit $dep}}{{end}}
+{{- end}}
+
+[Service]
+Type=notify
+NotifyAccess=all
+ExecStart={{arg .Exe}} run{{range .Args}} {{arg .}}{{end}}
+ExecReload=/bin/kill -HUP $MAINPID
+{{- with .Restart}}
+Restart={{.}}
+{{- end}}
+{{- if .RestartSec}}
+RestartSec={{sec .RestartSec}}
+{{- end}}
+{{- if .WatchdogSec}}
+WatchdogSec={{sec .WatchdogSec}}
+{{- end}}
+{{- if not .UserUnit}}
+{{- with .User}}
+User={{.}}
+{{- end}}
+{{- with .Group}}
+Group={{.}}
+{{- end}}
+{{- end}}
+{{- if not .UserUnit}}
+{{- with .RuntimeDirectory}}
+RuntimeDirectory={{.}}
+{{- end}}
+{{- end}}
+{{- with .WorkingDirectory}}
+WorkingDirectory={{.}}
+{{- end}}
+{{- if .UserUnit}}
+Environment={{.UserScopeEnv}}=1
+{{- end}}
+{{- range .Environment}}
+Environment={{quote .}}
+{{- end}}
+{{- if .LimitNOFILE}}
+LimitNOFILE={{.LimitNOFILE}}
+{{- end}}
+
+[Install]
+WantedBy={{if .UserUnit}}default.target{{else}}multi-user.target{{end}}
+`))
+
+// WriteSystemdUnit writes the systemd unit for the service to w. The
+// daemon tells systemd when it is ready, so the unit is Type=notify;
+// NotifyAccess=all lets the process started by an upgrade report in
+// before it becomes the main pid. A unit for the user's own service
+// manager runs as the user, tells the daemon so, and cannot require
+// system services.
+func (this *UnitOptions) WriteSystemdUnit(w io.Writer, desc, exe string, userUnit bool) error {
+	return serviceUnitTemplate.Execute(w, struct {
+		*UnitOptions
+		Description  string
+		Exe          string
+		UserUnit     bool
+		UserScopeEnv string
+	}{this, desc, exe, userUnit, config.USER_SCOPE_ENV})
+}
+
+// unitQuote quotes s as a single word for systemd, which also expands %
+// specifiers in it.
+func unitQuote(s string) string {
+	s = strings.Replace(s, "%", "%%", -1)
+	if s != "" && !strings.ContainsAny(s, " \t\n\"'\\;") {
+		return s
+	}
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return `"` + s + `"`
+}
+
+// execArg quotes s as an ExecStart= argument, where systemd expands $
+// variables as well.
+func execArg(s string) string {
+	return unitQuote(strings.Replace(s, "$", "$$", -1))
+}
+
+// unitName adds the .service suffix to a dependency given without one.
+func unitName(name string) string {
+	if strings.Contains(name, ".") {
+		return name
+	}
+	return name + ".service"
+}
+
+// unitSeconds formats d as systemd time span in seconds.
+func unitSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}